@@ -0,0 +1,68 @@
+// Command replay-reviews rebuilds SRS metadata from the review log, running
+// every logged review through a scheduler again. Use it after changing a
+// scheduler or to move users to another one without losing their history:
+// with -scheduler, the replayed users' preference is switched to it too.
+//
+//	go run ./cmd/replay-reviews -scheduler fsrs -dry-run
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"memoriva-backend/config"
+	"memoriva-backend/scheduler"
+	"memoriva-backend/services"
+	"os/signal"
+	"syscall"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	userID := flag.String("user", "", "only replay this user's reviews")
+	schedulerName := flag.String("scheduler", "", "scheduler to replay with and switch users to, "+scheduler.NameSM2+" or "+scheduler.NameFSRS+" (default: each user's preference)")
+	dryRun := flag.Bool("dry-run", false, "compute the new metadata without saving it")
+	flag.Parse()
+
+	if *schedulerName != "" {
+		if _, err := scheduler.ByName(*schedulerName); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found, using environment variables")
+	}
+	cfg := config.Load()
+
+	db, err := services.InitDatabase(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+	dbService := services.NewDatabaseService(db)
+	if err := dbService.Migrate(); err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	result, err := services.NewReviewService(dbService).Replay(ctx, services.ReplayOptions{
+		UserID:    *userID,
+		Scheduler: *schedulerName,
+		DryRun:    *dryRun,
+	})
+	if result != nil {
+		log.Printf("Replayed %d reviews of %d cards of %d users: %d rebuilt, %d with history older than the log, %d reviewed during the replay",
+			result.Reviews, result.Cards, result.Users, result.Rebuilt, result.Partial, result.Stale)
+	}
+	if err != nil {
+		log.Fatal("Replay failed:", err)
+	}
+	if *dryRun {
+		log.Println("Dry run, nothing was saved")
+	} else if *schedulerName != "" {
+		log.Printf("Switched %d users to %s", result.Users, *schedulerName)
+	}
+}
@@ -1,32 +1,124 @@
 package config
 
 import (
+	"log"
 	"os"
+	"strconv"
+	"time"
 )
 
 type Config struct {
 	DatabaseURL        string
-	DeepSeekAPIKey     string
 	OpenAIAPIKey       string
+	EmbeddingProvider  string
 	Port               string
 	AWSAccessKeyID     string
 	AWSSecretAccessKey string
 	AWSRegion          string
 	S3BucketName       string
 	CloudFrontBaseURL  string
+
+	// Retrieval fusion weights
+	RetrievalSemanticWeight float64
+	RetrievalLexicalWeight  float64
+	RetrievalWeaknessWeight float64
+	RetrievalRRFK           float64
+	RetrievalMaxCandidates  int
+
+	// Chat providers in fallback order, and per-task overrides of that order
+	LLMProviders []LLMProviderConfig
+	LLMRoutes    map[string][]string
+
+	// Circuit breaker applied to each chat provider
+	LLMBreakerThreshold int
+	LLMBreakerCooldown  time.Duration
+
+	// Durable study session queue
+	QueueWorkers           int
+	QueuePollInterval      time.Duration
+	QueueVisibilityTimeout time.Duration
+	QueueMaxPending        int
+	QueueJobTimeout        time.Duration
+
+	// Per-user fairness in the queue
+	QueueMaxQueuedPerUser  int
+	QueueMaxRunningPerUser int
+	QueueRetryAfter        time.Duration
+
+	// Retries for failed study sessions
+	QueueMaxAttempts int
+	QueueRetryBase   time.Duration
+	QueueRetryMax    time.Duration
+	QueueRetryJitter float64
+
+	// Users allowed to use the admin API
+	AdminUserIDs []string
+
+	// How long running sessions may take to finish on shutdown before they
+	// are handed back to the queue
+	ShutdownGracePeriod time.Duration
+
+	// Verification of NextAuth session tokens. AuthSecret must match the
+	// frontend's NEXTAUTH_SECRET; AuthJWKSURL enables RS256/ES256 tokens.
+	AuthSecret   string
+	AuthJWKSURL  string
+	AuthIssuer   string
+	AuthAudience string
+
+	// Dev mode trusts X-User-ID and falls back to a demo user. Never enable
+	// it in production.
+	AuthDevMode bool
 }
 
 func Load() *Config {
 	return &Config{
 		DatabaseURL:        getEnv("DATABASE_URL", ""),
-		DeepSeekAPIKey:     getEnv("DEEPSEEK_API_KEY", ""),
 		OpenAIAPIKey:       getEnv("OPENAI_API_KEY", ""),
+		EmbeddingProvider:  getEnv("EMBEDDING_PROVIDER", ""),
 		Port:               getEnv("PORT", "8080"),
 		AWSAccessKeyID:     getEnv("AWS_ACCESS_KEY_ID", ""),
 		AWSSecretAccessKey: getEnv("AWS_SECRET_ACCESS_KEY", ""),
 		AWSRegion:          getEnv("AWS_REGION", "us-east-1"),
 		S3BucketName:       getEnv("S3_BUCKET_NAME", ""),
 		CloudFrontBaseURL:  getEnv("CLOUDFRONT_BASE_URL", ""),
+
+		RetrievalSemanticWeight: getEnvFloat("RETRIEVAL_SEMANTIC_WEIGHT", 1.0),
+		RetrievalLexicalWeight:  getEnvFloat("RETRIEVAL_LEXICAL_WEIGHT", 1.0),
+		RetrievalWeaknessWeight: getEnvFloat("RETRIEVAL_WEAKNESS_WEIGHT", 0.3),
+		RetrievalRRFK:           getEnvFloat("RETRIEVAL_RRF_K", 60),
+		RetrievalMaxCandidates:  getEnvInt("RETRIEVAL_MAX_CANDIDATES", 300),
+
+		LLMProviders: loadLLMProviders(),
+		LLMRoutes:    loadLLMRoutes(),
+
+		LLMBreakerThreshold: getEnvInt("LLM_BREAKER_THRESHOLD", 3),
+		LLMBreakerCooldown:  getEnvDuration("LLM_BREAKER_COOLDOWN", 30*time.Second),
+
+		QueueWorkers:           getEnvInt("QUEUE_WORKERS", 3),
+		QueuePollInterval:      getEnvDuration("QUEUE_POLL_INTERVAL", 2*time.Second),
+		QueueVisibilityTimeout: getEnvDuration("QUEUE_VISIBILITY_TIMEOUT", 2*time.Minute),
+		QueueMaxPending:        getEnvInt("QUEUE_MAX_PENDING", 100),
+		QueueJobTimeout:        getEnvDuration("QUEUE_JOB_TIMEOUT", 5*time.Minute),
+
+		QueueMaxQueuedPerUser:  getEnvInt("QUEUE_MAX_QUEUED_PER_USER", 10),
+		QueueMaxRunningPerUser: getEnvInt("QUEUE_MAX_RUNNING_PER_USER", 2),
+		QueueRetryAfter:        getEnvDuration("QUEUE_RETRY_AFTER", 30*time.Second),
+
+		QueueMaxAttempts: getEnvInt("QUEUE_MAX_ATTEMPTS", 5),
+		QueueRetryBase:   getEnvDuration("QUEUE_RETRY_BASE_DELAY", 10*time.Second),
+		QueueRetryMax:    getEnvDuration("QUEUE_RETRY_MAX_DELAY", 10*time.Minute),
+		QueueRetryJitter: getEnvFloat("QUEUE_RETRY_JITTER", 0.2),
+
+		AdminUserIDs: splitList(getEnv("ADMIN_USER_IDS", "")),
+
+		ShutdownGracePeriod: getEnvDuration("SHUTDOWN_GRACE_PERIOD", 30*time.Second),
+
+		AuthSecret:   getEnv("AUTH_SECRET", getEnv("NEXTAUTH_SECRET", "")),
+		AuthJWKSURL:  getEnv("AUTH_JWKS_URL", ""),
+		AuthIssuer:   getEnv("AUTH_ISSUER", ""),
+		AuthAudience: getEnv("AUTH_AUDIENCE", ""),
+
+		AuthDevMode: getEnvBool("AUTH_DEV_MODE", false),
 	}
 }
 
@@ -36,3 +128,45 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %v", value, key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %v", value, key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %v", value, key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
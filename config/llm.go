@@ -0,0 +1,166 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// LLMProviderConfig describes one chat completion endpoint. Providers are
+// configured with LLM_PROVIDER_<NAME>_* environment variables.
+type LLMProviderConfig struct {
+	Name string
+	// Type selects the wire protocol: "openai" for any OpenAI-compatible
+	// endpoint (OpenAI, DeepSeek, Ollama, vLLM) or "anthropic"
+	Type    string
+	BaseURL string
+	Model   string
+	// APIKeyEnv names the environment variable holding the API key. Leave it
+	// empty for endpoints that need no key, such as a local Ollama.
+	APIKeyEnv string
+	APIKey    string
+	Timeout   time.Duration
+	// PromptTokens caps the input size of a single request, below the
+	// model's context window to keep costs predictable
+	PromptTokens int
+	// ResponseFormat is how OpenAI-compatible providers are asked for
+	// structured output: "json_schema", "json_object" or "none"
+	ResponseFormat string
+}
+
+// Built-in defaults so common providers only need an API key
+var defaultLLMProviders = map[string]LLMProviderConfig{
+	"deepseek": {
+		Type:         "openai",
+		BaseURL:      "https://api.deepseek.com/v1",
+		Model:        "deepseek-chat",
+		APIKeyEnv:    "DEEPSEEK_API_KEY",
+		PromptTokens: 24000,
+	},
+	"openai": {
+		Type:         "openai",
+		BaseURL:      "https://api.openai.com/v1",
+		Model:        "gpt-3.5-turbo",
+		APIKeyEnv:    "OPENAI_API_KEY",
+		PromptTokens: 12000,
+	},
+	"anthropic": {
+		Type:         "anthropic",
+		BaseURL:      "https://api.anthropic.com",
+		Model:        "claude-3-5-haiku-latest",
+		APIKeyEnv:    "ANTHROPIC_API_KEY",
+		PromptTokens: 24000,
+	},
+	"ollama": {
+		Type:         "openai",
+		BaseURL:      "http://localhost:11434/v1",
+		Model:        "llama3.1",
+		PromptTokens: 6000,
+	},
+}
+
+const (
+	defaultLLMTimeout      = 60 * time.Second
+	defaultLLMPromptTokens = 8000
+)
+
+// loadLLMProviders reads the providers listed in LLM_PROVIDERS, in order.
+// Providers whose API key variable is configured but empty are skipped.
+func loadLLMProviders() []LLMProviderConfig {
+	var providers []LLMProviderConfig
+
+	for _, name := range splitList(getEnv("LLM_PROVIDERS", "deepseek,openai")) {
+		provider := defaultLLMProviders[name]
+		provider.Name = name
+
+		prefix := "LLM_PROVIDER_" + envName(name) + "_"
+		provider.Type = getEnv(prefix+"TYPE", orDefault(provider.Type, "openai"))
+		provider.BaseURL = getEnv(prefix+"BASE_URL", provider.BaseURL)
+		provider.Model = getEnv(prefix+"MODEL", provider.Model)
+		provider.APIKeyEnv = getEnv(prefix+"API_KEY_ENV", provider.APIKeyEnv)
+		provider.Timeout = getEnvDuration(prefix+"TIMEOUT", defaultLLMTimeout)
+		provider.PromptTokens = getEnvInt(prefix+"PROMPT_TOKENS", orDefaultInt(provider.PromptTokens, defaultLLMPromptTokens))
+		provider.ResponseFormat = getEnv(prefix+"RESPONSE_FORMAT", "json_object")
+
+		if provider.Model == "" {
+			log.Printf("LLM provider %s has no model configured, skipping", name)
+			continue
+		}
+
+		if provider.APIKeyEnv != "" {
+			provider.APIKey = os.Getenv(provider.APIKeyEnv)
+			if provider.APIKey == "" {
+				continue
+			}
+		}
+
+		providers = append(providers, provider)
+	}
+
+	return providers
+}
+
+// loadLLMRoutes reads per-task provider lists from LLM_ROUTE_<TASK>, e.g.
+// LLM_ROUTE_CARD_SELECTION=deepseek,openai. Task names are lowercased.
+func loadLLMRoutes() map[string][]string {
+	routes := make(map[string][]string)
+
+	for _, entry := range os.Environ() {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(key, "LLM_ROUTE_") {
+			continue
+		}
+
+		task := strings.ToLower(strings.TrimPrefix(key, "LLM_ROUTE_"))
+		if names := splitList(value); len(names) > 0 {
+			routes[task] = names
+		}
+	}
+
+	return routes
+}
+
+func envName(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func orDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func orDefaultInt(value, defaultValue int) int {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	// Every duration configured here is a timeout, delay or tick interval, and
+	// time.NewTicker panics on a non-positive one
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("Invalid duration %q for %s, using default %v", value, key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
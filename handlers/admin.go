@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"memoriva-backend/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type AdminHandler struct {
+	queueService *services.QueueService
+	dbService    *services.DatabaseService
+}
+
+func NewAdminHandler(queueService *services.QueueService, dbService *services.DatabaseService) *AdminHandler {
+	return &AdminHandler{
+		queueService: queueService,
+		dbService:    dbService,
+	}
+}
+
+func (h *AdminHandler) ListDeadLetters(c *gin.Context) {
+	limit, offset := pagination(c)
+	includeRequeued := c.Query("includeRequeued") == "true"
+
+	deadLetters, total, err := h.dbService.ListDeadLetters(c.Request.Context(), limit, offset, includeRequeued)
+	if err != nil {
+		log.Printf("Failed to list dead letters: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list dead letters"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deadLetters": deadLetters,
+		"total":       total,
+		"limit":       limit,
+		"offset":      offset,
+	})
+}
+
+func (h *AdminHandler) GetDeadLetter(c *gin.Context) {
+	deadLetter, err := h.dbService.GetDeadLetter(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "dead letter not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get dead letter: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get dead letter"})
+		return
+	}
+
+	// Include the session so the failure can be inspected without a DB query
+	session, err := h.dbService.GetStudySession(c.Request.Context(), deadLetter.SessionID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Failed to get session for dead letter: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deadLetter": deadLetter,
+		"session":    session,
+	})
+}
+
+func (h *AdminHandler) RequeueDeadLetter(c *gin.Context) {
+	job, err := h.queueService.RequeueDeadLetter(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "dead letter not found"})
+		return
+	case errors.Is(err, services.ErrAlreadyRequeued), errors.Is(err, services.ErrAlreadyQueued):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("Failed to requeue dead letter: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue dead letter"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":   "Study session requeued",
+		"sessionId": job.SessionID,
+		"jobId":     job.ID,
+	})
+}
+
+// pagination reads limit and offset query parameters with sane bounds
+func pagination(c *gin.Context) (int, int) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 {
+		limit = 50
+	}
+	if limit > 200 {
+		limit = 200
+	}
+
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	return limit, offset
+}
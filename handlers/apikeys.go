@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"memoriva-backend/models"
+	"memoriva-backend/services"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type APIKeyHandler struct {
+	authService *services.AuthService
+	dbService   *services.DatabaseService
+}
+
+func NewAPIKeyHandler(authService *services.AuthService, dbService *services.DatabaseService) *APIKeyHandler {
+	return &APIKeyHandler{
+		authService: authService,
+		dbService:   dbService,
+	}
+}
+
+// CreateAPIKey issues a key for the requesting user. The full key is only
+// part of this response.
+func (h *APIKeyHandler) CreateAPIKey(c *gin.Context) {
+	var req models.CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(models.APIKeyScopes, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope " + scope})
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt must be in the future"})
+		return
+	}
+
+	// A key cannot outlive or grant more than the key used to create it
+	if value, ok := c.Get("apiKeyExpiresAt"); ok {
+		parentExpiresAt := value.(time.Time)
+		if req.ExpiresAt == nil || req.ExpiresAt.After(parentExpiresAt) {
+			req.ExpiresAt = &parentExpiresAt
+		}
+	}
+	if value, ok := c.Get("scopes"); ok {
+		granted := make(map[string]bool)
+		for _, scope := range value.([]string) {
+			granted[scope] = true
+		}
+		for _, scope := range req.Scopes {
+			if !granted[scope] {
+				c.JSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + scope + " scope"})
+				return
+			}
+		}
+	}
+
+	key, raw, err := h.authService.CreateAPIKey(c.Request.Context(), c.GetString("userID"), req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		log.Printf("Failed to create API key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.CreateAPIKeyResponse{
+		APIKeyResponse: apiKeyResponse(key),
+		Key:            raw,
+	})
+}
+
+func (h *APIKeyHandler) ListAPIKeys(c *gin.Context) {
+	keys, err := h.dbService.ListAPIKeys(c.Request.Context(), c.GetString("userID"))
+	if err != nil {
+		log.Printf("Failed to list API keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list API keys"})
+		return
+	}
+
+	response := make([]models.APIKeyResponse, 0, len(keys))
+	for i := range keys {
+		response = append(response, apiKeyResponse(&keys[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"apiKeys": response})
+}
+
+func (h *APIKeyHandler) RevokeAPIKey(c *gin.Context) {
+	key, err := h.dbService.RevokeAPIKey(c.Request.Context(), c.Param("id"), c.GetString("userID"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to revoke API key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, apiKeyResponse(key))
+}
+
+func apiKeyResponse(key *models.APIKey) models.APIKeyResponse {
+	return models.APIKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.ScopeList(),
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+		CreatedAt:  key.CreatedAt,
+	}
+}
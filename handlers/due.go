@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"memoriva-backend/models"
+	"memoriva-backend/services"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type DueHandler struct {
+	dbService *services.DatabaseService
+}
+
+func NewDueHandler(dbService *services.DatabaseService) *DueHandler {
+	return &DueHandler{
+		dbService: dbService,
+	}
+}
+
+// GetDeckDueCards returns the user's due queue for one deck
+func (h *DueHandler) GetDeckDueCards(c *gin.Context) {
+	h.dueCards(c, c.Param("id"))
+}
+
+// GetDueCards returns the user's due queue across their decks
+func (h *DueHandler) GetDueCards(c *gin.Context) {
+	h.dueCards(c, "")
+}
+
+// dueCards responds with the due queue. Days start at midnight in the IANA
+// time zone given by the tz query parameter, UTC by default.
+func (h *DueHandler) dueCards(c *gin.Context, deckID string) {
+	loc, err := time.LoadLocation(c.DefaultQuery("tz", "UTC"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tz must be a valid IANA time zone, such as Europe/Berlin"})
+		return
+	}
+
+	now := time.Now()
+	dayStart, dayEnd := services.DayBounds(now, loc)
+	queue, err := h.dbService.GetDueQueue(c.Request.Context(), c.GetString("userID"), deckID, dayStart, dayEnd)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "deck not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get due cards: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get due cards"})
+		return
+	}
+
+	response := models.DueCardsResponse{
+		DeckID:          deckID,
+		Cards:           make([]models.DueCardResponse, 0, len(queue.Reviews)+len(queue.New)),
+		ReviewCount:     len(queue.Reviews),
+		NewCount:        len(queue.New),
+		ReviewsDue:      queue.ReviewsDue,
+		NewAvailable:    queue.NewAvailable,
+		ReviewedToday:   queue.ReviewedToday,
+		IntroducedToday: queue.IntroducedToday,
+		ReviewLimit:     queue.ReviewLimit,
+		NewLimit:        queue.NewLimit,
+	}
+	for _, card := range queue.Reviews {
+		cardResponse := dueCardResponse(card)
+		cardResponse.DueAt = card.Metadata.NextReview
+		if card.Metadata.NextReview != nil && now.After(*card.Metadata.NextReview) {
+			cardResponse.OverdueDays = now.Sub(*card.Metadata.NextReview).Hours() / 24
+		}
+		cardResponse.Metadata = srsMetadataResponse(card.Metadata)
+		response.Cards = append(response.Cards, cardResponse)
+	}
+	for _, card := range queue.New {
+		cardResponse := dueCardResponse(card)
+		cardResponse.IsNew = true
+		response.Cards = append(response.Cards, cardResponse)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func dueCardResponse(card models.CardWithMetadata) models.DueCardResponse {
+	return models.DueCardResponse{
+		FlashcardID: card.Card.ID,
+		DeckID:      card.Card.DeckID,
+		Front:       card.Card.Front,
+		Back:        card.Card.Back,
+	}
+}
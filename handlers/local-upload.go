@@ -3,8 +3,10 @@ package handlers
 import (
 	"fmt"
 	"io"
+	"memoriva-backend/services"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 
 	"github.com/gin-gonic/gin"
@@ -45,9 +47,13 @@ func (h *LocalUploadHandler) UploadImage(c *gin.Context) {
 		return
 	}
 
-	// Generate unique filename
+	// Generate unique filename in the user's own directory
 	ext := getFileExtension(contentType)
-	filename := fmt.Sprintf("%s%s", uuid.New().String(), ext)
+	filename := path.Join(services.UserUploadPrefix(c.GetString("userID")), uuid.New().String()+ext)
+	if err := os.MkdirAll(filepath.Join(h.uploadDir, filepath.Dir(filename)), 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
+		return
+	}
 	filepath := filepath.Join(h.uploadDir, filename)
 
 	// Create the file
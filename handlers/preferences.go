@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"log"
+	"memoriva-backend/models"
+	"memoriva-backend/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PreferencesHandler struct {
+	dbService *services.DatabaseService
+}
+
+func NewPreferencesHandler(dbService *services.DatabaseService) *PreferencesHandler {
+	return &PreferencesHandler{
+		dbService: dbService,
+	}
+}
+
+func (h *PreferencesHandler) GetPreferences(c *gin.Context) {
+	preference, err := h.dbService.GetUserPreference(c.Request.Context(), c.GetString("userID"))
+	if err != nil {
+		log.Printf("Failed to get preferences: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get preferences"})
+		return
+	}
+
+	c.JSON(http.StatusOK, preferencesResponse(preference))
+}
+
+// UpdatePreferences saves the preferences sent, keeping the others. A new
+// scheduler applies from the next review on.
+func (h *PreferencesHandler) UpdatePreferences(c *gin.Context) {
+	var req models.PreferencesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	preference, err := h.dbService.GetUserPreference(c.Request.Context(), c.GetString("userID"))
+	if err != nil {
+		log.Printf("Failed to get preferences: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save preferences"})
+		return
+	}
+	if req.Scheduler != "" {
+		preference.Scheduler = req.Scheduler
+	}
+	if req.NewCardsPerDay != nil {
+		preference.NewCardsPerDay = *req.NewCardsPerDay
+	}
+	if req.ReviewsPerDay != nil {
+		preference.ReviewsPerDay = *req.ReviewsPerDay
+	}
+
+	if err := h.dbService.SaveUserPreference(c.Request.Context(), preference); err != nil {
+		log.Printf("Failed to save preferences: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save preferences"})
+		return
+	}
+
+	c.JSON(http.StatusOK, preferencesResponse(preference))
+}
+
+func preferencesResponse(preference *models.UserPreference) models.PreferencesResponse {
+	return models.PreferencesResponse{
+		Scheduler:      preference.Scheduler,
+		NewCardsPerDay: preference.NewCardsPerDay,
+		ReviewsPerDay:  preference.ReviewsPerDay,
+	}
+}
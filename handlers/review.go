@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"memoriva-backend/models"
+	"memoriva-backend/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type ReviewHandler struct {
+	reviewService *services.ReviewService
+}
+
+func NewReviewHandler(reviewService *services.ReviewService) *ReviewHandler {
+	return &ReviewHandler{
+		reviewService: reviewService,
+	}
+}
+
+// SubmitReview records the user's grade for a card and returns the card's
+// new schedule
+func (h *ReviewHandler) SubmitReview(c *gin.Context) {
+	var req models.SubmitReviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	metadata, sched, err := h.reviewService.SubmitReview(c.Request.Context(), c.GetString("userID"), req)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "card not found"})
+		return
+	case errors.Is(err, services.ErrSessionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	case errors.Is(err, services.ErrCardNotInSession):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("Failed to record review of card %s: %v", req.FlashcardID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record review"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SubmitReviewResponse{
+		FlashcardID:    req.FlashcardID,
+		Grade:          req.Grade,
+		Scheduler:      sched.Name(),
+		StudySessionID: req.StudySessionID,
+		Metadata:       *srsMetadataResponse(metadata),
+	})
+}
+
+// srsMetadataResponse describes a user's review history of a card
+func srsMetadataResponse(m *models.SRSCardMetadata) *models.SRSMetadataResponse {
+	return &models.SRSMetadataResponse{
+		EaseFactor:       m.EaseFactor,
+		Interval:         m.Interval,
+		Repetitions:      m.Repetitions,
+		LastReviewed:     m.LastReviewed,
+		NextReview:       m.NextReview,
+		EasyReviewCount:  m.EasyReviewCount,
+		HardReviewCount:  m.HardReviewCount,
+		AgainReviewCount: m.AgainReviewCount,
+		Stability:        m.Stability,
+		Difficulty:       m.Difficulty,
+	}
+}
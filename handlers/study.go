@@ -1,22 +1,34 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
 	"memoriva-backend/models"
 	"memoriva-backend/services"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 type StudyHandler struct {
 	queueService *services.QueueService
 	dbService    *services.DatabaseService
+	events       *services.EventBus
 }
 
-func NewStudyHandler(queueService *services.QueueService, dbService *services.DatabaseService) *StudyHandler {
+func NewStudyHandler(queueService *services.QueueService, dbService *services.DatabaseService, events *services.EventBus) *StudyHandler {
 	return &StudyHandler{
 		queueService: queueService,
 		dbService:    dbService,
+		events:       events,
 	}
 }
 
@@ -27,17 +39,74 @@ func (h *StudyHandler) ProcessStudySession(c *gin.Context) {
 		return
 	}
 
-	// Enqueue the study session for processing
-	if err := h.queueService.EnqueueStudySession(req.SessionID); err != nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{
-			"error": "Queue is full, please try again later",
-		})
+	if _, ok := h.ownedSession(c, req.SessionID); !ok {
+		return
+	}
+
+	if req.TimeZone != nil {
+		if _, err := time.LoadLocation(*req.TimeZone); err != nil || *req.TimeZone == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "tz must be a valid IANA time zone, such as Europe/Berlin"})
+			return
+		}
+	}
+
+	priority := models.JobPriorityInteractive
+	if req.Priority != "" {
+		priority = models.JobPriorities[req.Priority]
+	}
+
+	// Enqueue the study session for processing; repeating a request returns the existing job
+	job, created, err := h.queueService.EnqueueStudySession(c.Request.Context(), req.SessionID, priority, c.GetHeader("Idempotency-Key"), services.SessionOptions{
+		DueOnly:  req.DueOnly,
+		TimeZone: req.TimeZone,
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		if errors.Is(err, services.ErrIdempotencyKeyReused) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, services.ErrSessionCancelled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, services.ErrQueueDraining) {
+			c.Header("Retry-After", "5")
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "Server is shutting down, please try again",
+			})
+			return
+		}
+		if errors.Is(err, services.ErrUserQueueFull) || errors.Is(err, services.ErrQueueFull) {
+			retryAfter := int(math.Ceil(h.queueService.RetryAfter().Seconds()))
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error":      err.Error(),
+				"retryAfter": retryAfter,
+			})
+			return
+		}
+
+		log.Printf("Failed to enqueue session %s: %v", req.SessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enqueue study session"})
 		return
 	}
 
-	c.JSON(http.StatusAccepted, gin.H{
-		"message":   "Study session processing started",
+	status, message := http.StatusAccepted, "Study session processing started"
+	if !created {
+		status, message = http.StatusOK, "Study session is already being processed"
+	}
+
+	c.JSON(status, gin.H{
+		"message":   message,
 		"sessionId": req.SessionID,
+		"jobId":     job.ID,
+		"jobStatus": job.Status,
+		"attempts":  job.Attempts,
+		"duplicate": !created,
 	})
 }
 
@@ -47,16 +116,237 @@ func (h *StudyHandler) GetStudySessionStatus(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "session ID is required"})
 		return
 	}
+	if _, ok := h.ownedSession(c, sessionID); !ok {
+		return
+	}
 
-	// Get the actual session status from database
-	session, err := h.dbService.GetStudySession(sessionID)
+	status, err := h.dbService.GetStudySessionStatus(c.Request.Context(), sessionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
 	if err != nil {
+		log.Printf("Failed to get status of session %s: %v", sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get session status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+func (h *StudyHandler) CancelStudySession(c *gin.Context) {
+	sessionID := c.Param("id")
+	if sessionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "session ID is required"})
+		return
+	}
+	if _, ok := h.ownedSession(c, sessionID); !ok {
+		return
+	}
+
+	err := h.queueService.CancelStudySession(c.Request.Context(), sessionID)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
 		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
 		return
+	case errors.Is(err, services.ErrSessionNotCancellable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("Failed to cancel session %s: %v", sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel study session"})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"id":     sessionID,
-		"status": session.Status,
+		"status": models.SessionStatusCancelled,
 	})
 }
+
+// GetStudySessionCards returns a page of a READY session's cards in study
+// order. The response carries an ETag so clients can revalidate cheaply.
+func (h *StudyHandler) GetStudySessionCards(c *gin.Context) {
+	sessionID := c.Param("id")
+	userID := c.GetString("userID")
+
+	session, ok := h.ownedSession(c, sessionID)
+	if !ok {
+		return
+	}
+
+	if session.Status != models.SessionStatusReady {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "session is not ready",
+			"status": session.Status,
+		})
+		return
+	}
+
+	limit, offset := pagination(c)
+	cards, metadata, total, err := h.dbService.GetStudySessionCards(c.Request.Context(), sessionID, userID, limit, offset)
+	if err != nil {
+		log.Printf("Failed to get cards of session %s: %v", sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get session cards"})
+		return
+	}
+
+	response := models.StudySessionCardsResponse{
+		SessionID: sessionID,
+		Cards:     make([]models.StudySessionCardResponse, 0, len(cards)),
+		Total:     total,
+		Limit:     limit,
+		Offset:    offset,
+	}
+	for _, card := range cards {
+		cardResponse := models.StudySessionCardResponse{
+			Order:          card.Order,
+			FlashcardID:    card.FlashcardID,
+			Front:          card.Flashcard.Front,
+			Back:           card.Flashcard.Back,
+			Reason:         card.Reason,
+			SelectionScore: card.Score,
+			IsRepeat:       card.Repeat,
+		}
+		if m, ok := metadata[card.FlashcardID]; ok {
+			cardResponse.Metadata = srsMetadataResponse(&m)
+		}
+		response.Cards = append(response.Cards, cardResponse)
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode session cards"})
+		return
+	}
+
+	// The ETag covers card content and review metadata, so it changes when
+	// either is edited
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// ownedSession loads a session of the requesting user, responding with an
+// error and returning false otherwise. Sessions of other users are reported
+// as missing rather than forbidden.
+func (h *StudyHandler) ownedSession(c *gin.Context, sessionID string) (*models.StudySession, bool) {
+	session, err := h.dbService.GetStudySession(c.Request.Context(), sessionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && session.UserID != c.GetString("userID")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to get session %s: %v", sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get session"})
+		return nil, false
+	}
+	return session, true
+}
+
+// etagMatches reports whether an If-None-Match header lists the ETag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// How often an idle event stream sends a keep-alive and rechecks the
+// session in the database, which catches sessions processed by another
+// replica
+const eventStreamPollInterval = 15 * time.Second
+
+// StreamStudySessionEvents streams the session's progress as Server-Sent
+// Events until it reaches a terminal stage or the client disconnects
+func (h *StudyHandler) StreamStudySessionEvents(c *gin.Context) {
+	sessionID := c.Param("id")
+
+	// Subscribe before reading the session so no transition is missed
+	events, latest, unsubscribe := h.events.Subscribe(sessionID)
+	defer unsubscribe()
+
+	session, ok := h.ownedSession(c, sessionID)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	send := func(event services.SessionEvent) bool {
+		c.SSEvent("progress", event)
+		c.Writer.Flush()
+		return !event.Stage.Terminal()
+	}
+
+	// Start from the latest published stage, or from the stored status
+	current := sessionStatusEvent(session)
+	if latest != nil && !current.Stage.Terminal() {
+		current = *latest
+	}
+	if !send(current) {
+		return
+	}
+
+	ticker := time.NewTicker(eventStreamPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok || !send(event) {
+				return
+			}
+		case <-ticker.C:
+			session, err := h.dbService.GetStudySession(c.Request.Context(), sessionID)
+			if err == nil {
+				if event := sessionStatusEvent(session); event.Stage.Terminal() {
+					send(event)
+					return
+				}
+			}
+			c.Writer.WriteString(": keep-alive\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
+
+// sessionStatusEvent describes a session's stored status as a progress event
+func sessionStatusEvent(session *models.StudySession) services.SessionEvent {
+	stage := services.StageQueued
+	switch session.Status {
+	case models.SessionStatusProcessing:
+		stage = services.StageProcessing
+	case models.SessionStatusReady:
+		stage = services.StageReady
+	case models.SessionStatusFailed:
+		stage = services.StageFailed
+	case models.SessionStatusCancelled:
+		stage = services.StageCancelled
+	}
+
+	event := services.SessionEvent{
+		SessionID: session.ID,
+		Stage:     stage,
+		At:        time.Now(),
+	}
+	if session.CompletedAt != nil {
+		event.At = *session.CompletedAt
+	}
+	return event
+}
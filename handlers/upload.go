@@ -44,7 +44,7 @@ func (h *UploadHandler) GeneratePresignedURL(c *gin.Context) {
 		return
 	}
 
-	response, err := h.s3Service.GeneratePresignedUploadURL(req.ContentType)
+	response, err := h.s3Service.GeneratePresignedUploadURL(c.GetString("userID"), req.ContentType)
 	if err != nil {
 		log.Printf("Failed to generate presigned URL: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate upload URL"})
@@ -96,8 +96,8 @@ func (h *UploadHandler) UploadToS3(c *gin.Context) {
 		return
 	}
 
-	// Upload to S3
-	imageURL, err := h.s3Service.UploadFile(file, contentType)
+	// Upload to S3 under the user's own prefix
+	imageURL, err := h.s3Service.UploadFile(c.GetString("userID"), file, contentType)
 	if err != nil {
 		log.Printf("Failed to upload to S3: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload image"})
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"memoriva-backend/config"
 	"memoriva-backend/handlers"
 	"memoriva-backend/middleware"
+	"memoriva-backend/models"
 	"memoriva-backend/services"
+	"net/http"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -28,9 +34,52 @@ func main() {
 
 	// Initialize services
 	dbService := services.NewDatabaseService(db)
-	llmService := services.NewLLMService(cfg.DeepSeekAPIKey, cfg.OpenAIAPIKey)
-	embeddingService := services.NewEmbeddingService(cfg.OpenAIAPIKey)
-	ragService := services.NewRAGService(dbService, llmService, embeddingService)
+	if err := dbService.Migrate(); err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+
+	providerRegistry, err := services.NewProviderRegistry(cfg.LLMProviders, cfg.LLMRoutes)
+	if err != nil {
+		log.Fatal("Failed to initialize LLM providers:", err)
+	}
+	// Shared by the ranking, the LLM prompt and both fallback selectors
+	weakness := services.NewWeaknessModel()
+
+	llmService := services.NewLLMService(providerRegistry, services.BreakerConfig{
+		FailureThreshold: cfg.LLMBreakerThreshold,
+		Cooldown:         cfg.LLMBreakerCooldown,
+	}, weakness)
+	embedder, err := services.NewEmbedder(cfg.EmbeddingProvider, cfg.OpenAIAPIKey)
+	if err != nil {
+		log.Fatal("Failed to initialize embedder:", err)
+	}
+	log.Printf("Using embedding model %s", embedder.Model())
+
+	// Session progress published by workers and streamed to clients
+	events := services.NewEventBus()
+
+	ragService := services.NewRAGService(dbService, llmService, embedder, services.RankingConfig{
+		SemanticWeight: cfg.RetrievalSemanticWeight,
+		LexicalWeight:  cfg.RetrievalLexicalWeight,
+		WeaknessWeight: cfg.RetrievalWeaknessWeight,
+		RRFK:           cfg.RetrievalRRFK,
+		CandidateLimit: cfg.RetrievalMaxCandidates,
+	}, weakness, events)
+
+	authService := services.NewAuthService(dbService, services.AuthConfig{
+		Secret:   cfg.AuthSecret,
+		JWKSURL:  cfg.AuthJWKSURL,
+		Issuer:   cfg.AuthIssuer,
+		Audience: cfg.AuthAudience,
+	})
+	if cfg.AuthDevMode {
+		log.Println("WARNING: AUTH_DEV_MODE is enabled, unauthenticated requests act as X-User-ID or the demo user")
+	} else if !authService.Configured() {
+		log.Fatal("AUTH_SECRET or AUTH_JWKS_URL must be set unless AUTH_DEV_MODE is enabled")
+	}
+
+	// Reviews reschedule cards with each user's preferred scheduler
+	reviewService := services.NewReviewService(dbService)
 
 	// Initialize S3 service
 	s3Service, err := services.NewS3Service(cfg)
@@ -38,12 +87,31 @@ func main() {
 		log.Fatal("Failed to initialize S3 service:", err)
 	}
 
-	// Initialize queue service with 3 workers for concurrent processing
-	queueService := services.NewQueueService(3, ragService, dbService)
+	// Initialize the durable queue service with concurrent workers
+	queueService := services.NewQueueService(cfg.QueueWorkers, ragService, dbService, events, services.QueueConfig{
+		PollInterval:      cfg.QueuePollInterval,
+		VisibilityTimeout: cfg.QueueVisibilityTimeout,
+		MaxQueued:         cfg.QueueMaxPending,
+		MaxQueuedPerUser:  cfg.QueueMaxQueuedPerUser,
+		MaxRunningPerUser: cfg.QueueMaxRunningPerUser,
+		RetryAfter:        cfg.QueueRetryAfter,
+		Retry: services.RetryPolicy{
+			MaxAttempts: cfg.QueueMaxAttempts,
+			BaseDelay:   cfg.QueueRetryBase,
+			MaxDelay:    cfg.QueueRetryMax,
+			Jitter:      cfg.QueueRetryJitter,
+		},
+		JobTimeout: cfg.QueueJobTimeout,
+	})
 	queueService.Start()
 
 	// Initialize handlers with queue service and database service
-	studyHandler := handlers.NewStudyHandler(queueService, dbService)
+	studyHandler := handlers.NewStudyHandler(queueService, dbService, events)
+	adminHandler := handlers.NewAdminHandler(queueService, dbService)
+	apiKeyHandler := handlers.NewAPIKeyHandler(authService, dbService)
+	reviewHandler := handlers.NewReviewHandler(reviewService)
+	preferencesHandler := handlers.NewPreferencesHandler(dbService)
+	dueHandler := handlers.NewDueHandler(dbService)
 	uploadHandler := handlers.NewUploadHandler(s3Service)
 	localUploadHandler := handlers.NewLocalUploadHandler()
 
@@ -58,23 +126,81 @@ func main() {
 
 	// Health check endpoint (no auth required)
 	r.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"status":  "healthy",
-			"service": "memoriva-rag-backend",
+		providers := llmService.ProviderStatuses()
+
+		// Degraded when no provider can currently serve requests
+		status := "healthy"
+		available := 0
+		for _, provider := range providers {
+			if provider.Breaker.State != services.BreakerOpen {
+				available++
+			}
+		}
+		if available == 0 {
+			status = "degraded"
+		}
+
+		// Tell load balancers to stop routing here while shutting down
+		code := http.StatusOK
+		if queueService.Draining() {
+			status = "draining"
+			code = http.StatusServiceUnavailable
+		}
+
+		c.JSON(code, gin.H{
+			"status":       status,
+			"service":      "memoriva-rag-backend",
+			"llmProviders": providers,
 		})
 	})
 
 	// API routes with authentication
 	api := r.Group("/api")
-	api.Use(middleware.AuthMiddleware()) // Require authentication for all API routes
+	api.Use(middleware.AuthMiddleware(authService, cfg.AuthDevMode)) // Require authentication for all API routes
 	{
+		// API keys are limited to the routes their scopes cover
+		readSessions := middleware.RequireScope(models.ScopeSessionsRead)
+		writeSessions := middleware.RequireScope(models.ScopeSessionsWrite)
+
 		studySessions := api.Group("/study-sessions")
 		{
-			studySessions.POST("/process", studyHandler.ProcessStudySession)
-			studySessions.GET("/:id/status", studyHandler.GetStudySessionStatus)
+			studySessions.POST("/process", writeSessions, studyHandler.ProcessStudySession)
+			studySessions.GET("/:id/status", readSessions, studyHandler.GetStudySessionStatus)
+			studySessions.GET("/:id/events", readSessions, studyHandler.StreamStudySessionEvents)
+			studySessions.GET("/:id/cards", readSessions, studyHandler.GetStudySessionCards)
+			studySessions.POST("/:id/cancel", writeSessions, studyHandler.CancelStudySession)
+		}
+
+		api.POST("/reviews", middleware.RequireScope(models.ScopeReviews), reviewHandler.SubmitReview)
+
+		readReviews := middleware.RequireScope(models.ScopeReviewsRead)
+		api.GET("/due", readReviews, dueHandler.GetDueCards)
+		api.GET("/decks/:id/due", readReviews, dueHandler.GetDeckDueCards)
+
+		preferences := api.Group("/preferences")
+		{
+			preferences.GET("", middleware.RequireScope(models.ScopePreferencesRead), preferencesHandler.GetPreferences)
+			preferences.PUT("", middleware.RequireScope(models.ScopePreferencesWrite), preferencesHandler.UpdatePreferences)
+		}
+
+		apiKeys := api.Group("/api-keys")
+		apiKeys.Use(middleware.RequireScope(models.ScopeAPIKeys))
+		{
+			apiKeys.POST("", apiKeyHandler.CreateAPIKey)
+			apiKeys.GET("", apiKeyHandler.ListAPIKeys)
+			apiKeys.DELETE("/:id", apiKeyHandler.RevokeAPIKey)
+		}
+
+		admin := api.Group("/admin")
+		admin.Use(middleware.RequireScope(models.ScopeAdmin), middleware.AdminMiddleware(cfg.AdminUserIDs))
+		{
+			admin.GET("/dead-letters", adminHandler.ListDeadLetters)
+			admin.GET("/dead-letters/:id", adminHandler.GetDeadLetter)
+			admin.POST("/dead-letters/:id/requeue", adminHandler.RequeueDeadLetter)
 		}
 
 		upload := api.Group("/upload")
+		upload.Use(middleware.RequireScope(models.ScopeUploads))
 		{
 			upload.POST("/presigned-url", uploadHandler.GeneratePresignedURL)
 			upload.POST("/s3", uploadHandler.UploadToS3)          // Direct S3 upload endpoint
@@ -88,8 +214,46 @@ func main() {
 		port = "8080"
 	}
 
-	log.Printf("Starting server on port %s", port)
-	if err := r.Run(":" + port); err != nil {
-		log.Fatal("Failed to start server:", err)
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: r,
+	}
+
+	go func() {
+		log.Printf("Starting server on port %s", port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	// Wait for SIGINT (Ctrl+C) or SIGTERM (systemd, Docker)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop()
+
+	log.Printf("Shutting down, waiting up to %v for running sessions", cfg.ShutdownGracePeriod)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGracePeriod)
+	defer cancel()
+
+	// Stop taking new sessions first, but keep serving status and cancel
+	// requests while running sessions finish
+	if err := queueService.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Queue did not drain in time: %v", err)
 	}
+
+	// End open event streams so the HTTP server can finish
+	events.Close()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server did not shut down cleanly: %v", err)
+		srv.Close()
+	}
+
+	if sqlDB, err := db.DB(); err == nil {
+		if err := sqlDB.Close(); err != nil {
+			log.Printf("Failed to close database pool: %v", err)
+		}
+	}
+
+	log.Println("Server stopped")
 }
@@ -1,25 +1,103 @@
 package middleware
 
 import (
+	"errors"
+	"log"
+	"memoriva-backend/services"
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 )
 
-// AuthMiddleware validates the user session
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware verifies the NextAuth session token, or the personal API
+// key in x-api-key, and sets the user it belongs to. API key requests also
+// get the key's scopes, checked by RequireScope. In dev mode, requests
+// without a valid token fall back to the X-User-ID header or the demo user;
+// other failures, such as a database error, are still reported.
+func AuthMiddleware(authService *services.AuthService, devMode bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get the user ID from the request header (passed from frontend)
-		userID := c.GetHeader("X-User-ID")
-		userEmail := c.GetHeader("X-User-Email")
-
-		// For development, allow requests without authentication
-		// In production, you'd validate the NextAuth session token
-		if userID == "" && userEmail == "" {
-			// Allow demo user for development
-			c.Set("userID", "demo-user-id")
-			c.Set("userEmail", "devyk100@gmail.com")
-		} else {
+		if apiKey := c.GetHeader("x-api-key"); apiKey != "" {
+			user, key, err := authService.AuthenticateAPIKey(c.Request.Context(), apiKey)
+			if err != nil {
+				abortUnauthenticated(c, err)
+				return
+			}
+			c.Set("userID", user.ID)
+			c.Set("userEmail", user.Email)
+			c.Set("apiKeyID", key.ID)
+			c.Set("scopes", key.ScopeList())
+			if key.ExpiresAt != nil {
+				c.Set("apiKeyExpiresAt", *key.ExpiresAt)
+			}
+			c.Next()
+			return
+		}
+
+		user, err := authService.Authenticate(c.Request.Context(), c.Request)
+		if err == nil {
+			c.Set("userID", user.ID)
+			c.Set("userEmail", user.Email)
+			c.Next()
+			return
+		}
+
+		if devMode && errors.Is(err, services.ErrUnauthenticated) {
+			userID := c.GetHeader("X-User-ID")
+			userEmail := c.GetHeader("X-User-Email")
+			if userID == "" && userEmail == "" {
+				userID = "demo-user-id"
+				userEmail = "devyk100@gmail.com"
+			}
 			c.Set("userID", userID)
 			c.Set("userEmail", userEmail)
+			c.Next()
+			return
+		}
+
+		abortUnauthenticated(c, err)
+	}
+}
+
+func abortUnauthenticated(c *gin.Context, err error) {
+	if !errors.Is(err, services.ErrUnauthenticated) {
+		log.Printf("Failed to authenticate request: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to authenticate"})
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+}
+
+// RequireScope restricts a route group to API keys granted the scope.
+// Requests authenticated with a session token are not limited by scopes.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, ok := c.Get("scopes")
+		if !ok {
+			c.Next()
+			return
+		}
+
+		for _, granted := range value.([]string) {
+			if granted == scope {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + scope + " scope"})
+	}
+}
+
+// AdminMiddleware restricts a route group to the configured admin users
+func AdminMiddleware(adminUserIDs []string) gin.HandlerFunc {
+	admins := make(map[string]bool, len(adminUserIDs))
+	for _, id := range adminUserIDs {
+		admins[id] = true
+	}
+
+	return func(c *gin.Context) {
+		if !admins[c.GetString("userID")] {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+			return
 		}
 
 		c.Next()
@@ -31,8 +109,9 @@ func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Credentials", "true")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-User-ID, X-User-Email, x-api-key")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-User-ID, X-User-Email, x-api-key, Idempotency-Key, If-None-Match")
 		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		c.Header("Access-Control-Expose-Headers", "ETag, Retry-After")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -1,6 +1,10 @@
 package models
 
 import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -39,6 +43,10 @@ type SRSCardMetadata struct {
 	EasyReviewCount  int        `gorm:"column:easyReviewCount;default:0"`
 	HardReviewCount  int        `gorm:"column:hardReviewCount;default:0"`
 	AgainReviewCount int        `gorm:"column:againReviewCount;default:0"`
+	LastSessionID    *string    `gorm:"column:lastStudySessionId"` // Added by this backend
+	Stability        *float64   `gorm:"column:stability"`          // Added by this backend (FSRS)
+	Difficulty       *float64   `gorm:"column:difficulty"`         // Added by this backend (FSRS)
+	IntroducedAt     *time.Time `gorm:"column:introducedAt"`       // Added by this backend
 	User             User       `gorm:"foreignKey:UserID"`
 	Flashcard        Flashcard  `gorm:"foreignKey:FlashcardID"`
 }
@@ -52,6 +60,8 @@ type StudySession struct {
 	Status      string             `gorm:"column:status;type:varchar(20);default:'PENDING'"`
 	CreatedAt   time.Time          `gorm:"column:createdAt;default:CURRENT_TIMESTAMP"`
 	CompletedAt *time.Time         `gorm:"column:completedAt"`
+	DueOnly     bool               `gorm:"column:dueOnly"`                // Added by this backend
+	TimeZone    string             `gorm:"column:timeZone;default:'UTC'"` // Added by this backend
 	User        User               `gorm:"foreignKey:UserID"`
 	Deck        FlashcardDeck      `gorm:"foreignKey:DeckID"`
 	Cards       []StudySessionCard `gorm:"foreignKey:StudySessionID"`
@@ -61,11 +71,23 @@ func (StudySession) TableName() string {
 	return "StudySession"
 }
 
+// Study session statuses. CANCELLED is set only by this backend.
+const (
+	SessionStatusPending    = "PENDING"
+	SessionStatusProcessing = "PROCESSING"
+	SessionStatusReady      = "READY"
+	SessionStatusFailed     = "FAILED"
+	SessionStatusCancelled  = "CANCELLED"
+)
+
 type StudySessionCard struct {
 	ID             string       `gorm:"primaryKey;column:id"`
 	StudySessionID string       `gorm:"column:studySessionId"`
 	FlashcardID    string       `gorm:"column:flashcardId"`
 	Order          int          `gorm:"column:order"`
+	Reason         *string      `gorm:"column:selectionReason"` // Added by this backend
+	Score          *float64     `gorm:"column:selectionScore"`  // Added by this backend
+	Repeat         bool         `gorm:"column:isRepeat"`        // Added by this backend
 	StudySession   StudySession `gorm:"foreignKey:StudySessionID"`
 	Flashcard      Flashcard    `gorm:"foreignKey:FlashcardID"`
 }
@@ -74,6 +96,253 @@ func (StudySessionCard) TableName() string {
 	return "StudySessionCard"
 }
 
+// Backend-owned models (not part of the Prisma schema)
+
+// CardEmbedding caches a card's vector for one embedding model. ContentHash
+// tracks the Front/Back text the vector was computed from.
+type CardEmbedding struct {
+	ID          string    `gorm:"primaryKey;column:id"`
+	FlashcardID string    `gorm:"column:flashcardId"`
+	Model       string    `gorm:"column:model"`
+	ContentHash string    `gorm:"column:contentHash"`
+	Embedding   Vector    `gorm:"column:embedding"`
+	UpdatedAt   time.Time `gorm:"column:updatedAt"`
+}
+
+func (CardEmbedding) TableName() string {
+	return "CardEmbedding"
+}
+
+// Job statuses for StudySessionJob
+const (
+	JobStatusQueued    = "QUEUED"
+	JobStatusRunning   = "RUNNING"
+	JobStatusDone      = "DONE"
+	JobStatusFailed    = "FAILED"
+	JobStatusCancelled = "CANCELLED"
+)
+
+// Job priorities; workers take lower values first. Interactive jobs are
+// sessions a user is waiting for, batch jobs are pre-generated in the
+// background.
+const (
+	JobPriorityInteractive = 0
+	JobPriorityBatch       = 1
+)
+
+// JobPriorities maps the priority names accepted by the API to their values
+var JobPriorities = map[string]int{
+	"interactive": JobPriorityInteractive,
+	"batch":       JobPriorityBatch,
+}
+
+// StudySessionJob is a durable request to generate a study session. Workers
+// claim jobs with a lock that expires unless renewed by heartbeats, so jobs
+// held by a crashed worker become available again.
+type StudySessionJob struct {
+	ID          string     `gorm:"primaryKey;column:id"`
+	SessionID   string     `gorm:"column:sessionId;not null;index"`
+	UserID      string     `gorm:"column:userId;not null;default:'';index;uniqueIndex:idx_study_session_job_idempotency,priority:1"`
+	Priority    int        `gorm:"column:priority;not null;default:0"`
+	RequestKey  *string    `gorm:"column:idempotencyKey;uniqueIndex:idx_study_session_job_idempotency,priority:2"` // Idempotency-Key header, unique per user
+	Status      string     `gorm:"column:status;type:varchar(20);not null;index:idx_study_session_job_claim,priority:1"`
+	Attempts    int        `gorm:"column:attempts;not null;default:0"`
+	RunAt       time.Time  `gorm:"column:runAt;not null;index:idx_study_session_job_claim,priority:2"`
+	LockedBy    *string    `gorm:"column:lockedBy"`
+	LockedUntil *time.Time `gorm:"column:lockedUntil"`
+	LastError   *string    `gorm:"column:lastError"`
+	CreatedAt   time.Time  `gorm:"column:createdAt"`
+	UpdatedAt   time.Time  `gorm:"column:updatedAt"`
+}
+
+func (StudySessionJob) TableName() string {
+	return "StudySessionJob"
+}
+
+// Reasons a job was dead-lettered
+const (
+	DeadLetterPermanent        = "permanent_error"
+	DeadLetterRetriesExhausted = "retries_exhausted"
+)
+
+// StudySessionDeadLetter records a job that failed for good, kept so it can be
+// inspected and requeued by an admin
+type StudySessionDeadLetter struct {
+	ID         string     `gorm:"primaryKey;column:id"`
+	JobID      string     `gorm:"column:jobId;not null;index"`
+	SessionID  string     `gorm:"column:sessionId;not null;index"`
+	Reason     string     `gorm:"column:reason;type:varchar(32);not null"`
+	Attempts   int        `gorm:"column:attempts;not null"`
+	LastError  string     `gorm:"column:lastError;not null"`
+	FailedAt   time.Time  `gorm:"column:failedAt;not null"`
+	RequeuedAt *time.Time `gorm:"column:requeuedAt"`
+}
+
+func (StudySessionDeadLetter) TableName() string {
+	return "StudySessionDeadLetter"
+}
+
+// StudySessionResult records how the latest processing attempt of a session
+// went, for the status API. Successful attempts clear the error fields.
+type StudySessionResult struct {
+	SessionID     string    `gorm:"primaryKey;column:sessionId"`
+	Attempt       int       `gorm:"column:attempt;not null"`
+	Provider      *string   `gorm:"column:provider"`
+	Model         *string   `gorm:"column:model"`
+	UsedFallback  bool      `gorm:"column:usedFallback;not null;default:false"`
+	ErrorCode     *string   `gorm:"column:errorCode;type:varchar(32)"`
+	FailureReason *string   `gorm:"column:failureReason"`
+	UpdatedAt     time.Time `gorm:"column:updatedAt"`
+}
+
+func (StudySessionResult) TableName() string {
+	return "StudySessionResult"
+}
+
+// UserPreference holds per-user settings of this backend. Users without a
+// row use the defaults.
+type UserPreference struct {
+	UserID         string    `gorm:"primaryKey;column:userId"`
+	Scheduler      string    `gorm:"column:scheduler;type:varchar(16);not null"`
+	NewCardsPerDay int       `gorm:"column:newCardsPerDay;not null;default:20"`
+	ReviewsPerDay  int       `gorm:"column:reviewsPerDay;not null;default:200"`
+	UpdatedAt      time.Time `gorm:"column:updatedAt"`
+}
+
+// Daily limits of the due queue for users without preferences
+const (
+	DefaultNewCardsPerDay = 20
+	DefaultReviewsPerDay  = 200
+)
+
+func (UserPreference) TableName() string {
+	return "UserPreference"
+}
+
+// ReviewLog records a single review, written alongside the update to
+// SRSCardMetadata. FirstReview marks the review that introduced the card, so
+// a card's log is complete from there on and can be replayed with another
+// scheduler.
+type ReviewLog struct {
+	ID               string    `gorm:"primaryKey;column:id"`
+	UserID           string    `gorm:"column:userId;not null;index:idx_review_log_card,priority:1"`
+	FlashcardID      string    `gorm:"column:flashcardId;not null;index:idx_review_log_card,priority:2"`
+	SessionID        *string   `gorm:"column:studySessionId;index"`
+	Grade            string    `gorm:"column:grade;type:varchar(8);not null"`
+	ResponseMs       *int      `gorm:"column:responseTimeMs"`
+	PreviousInterval int64     `gorm:"column:previousInterval;not null"`
+	NextInterval     int64     `gorm:"column:nextInterval;not null"`
+	FirstReview      bool      `gorm:"column:firstReview;not null"`
+	Scheduler        string    `gorm:"column:scheduler;type:varchar(16);not null"`
+	SchedulerVersion string    `gorm:"column:schedulerVersion;type:varchar(32);not null"`
+	ReviewedAt       time.Time `gorm:"column:reviewedAt;not null;index:idx_review_log_card,priority:3"`
+}
+
+func (ReviewLog) TableName() string {
+	return "ReviewLog"
+}
+
+// Scopes an API key can be granted. Requests authenticated with a session
+// token may use every route.
+const (
+	ScopeSessionsRead     = "sessions:read"
+	ScopeSessionsWrite    = "sessions:write"
+	ScopeUploads          = "uploads:write"
+	ScopeReviews          = "reviews:write"
+	ScopeReviewsRead      = "reviews:read"
+	ScopePreferencesRead  = "preferences:read"
+	ScopePreferencesWrite = "preferences:write"
+	ScopeAPIKeys          = "api_keys:manage"
+	ScopeAdmin            = "admin"
+)
+
+// APIKeyScopes lists every scope an API key can be granted
+var APIKeyScopes = []string{ScopeSessionsRead, ScopeSessionsWrite, ScopeUploads, ScopeReviews, ScopeReviewsRead, ScopePreferencesRead, ScopePreferencesWrite, ScopeAPIKeys, ScopeAdmin}
+
+// APIKey is a personal key for scripted access, sent in the x-api-key
+// header. Only a SHA-256 hash of the secret is stored; Prefix identifies the
+// key and is shown so users can tell their keys apart.
+type APIKey struct {
+	ID         string     `gorm:"primaryKey;column:id"`
+	UserID     string     `gorm:"column:userId;not null;index"`
+	Name       string     `gorm:"column:name;not null"`
+	Prefix     string     `gorm:"column:prefix;not null;uniqueIndex"`
+	SecretHash string     `gorm:"column:secretHash;not null"`
+	Scopes     string     `gorm:"column:scopes;not null"` // comma-separated
+	ExpiresAt  *time.Time `gorm:"column:expiresAt"`
+	LastUsedAt *time.Time `gorm:"column:lastUsedAt"`
+	RevokedAt  *time.Time `gorm:"column:revokedAt"`
+	CreatedAt  time.Time  `gorm:"column:createdAt"`
+}
+
+func (APIKey) TableName() string {
+	return "ApiKey"
+}
+
+// ScopeList returns the key's scopes
+func (k *APIKey) ScopeList() []string {
+	if k.Scopes == "" {
+		return nil
+	}
+	return strings.Split(k.Scopes, ",")
+}
+
+// Vector is stored using the pgvector text format ("[1,2,3]"), which is also
+// readable from a plain text column when the extension is not installed.
+type Vector []float32
+
+func (v Vector) Value() (driver.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('[')
+	for i, f := range v {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.FormatFloat(float64(f), 'f', -1, 32))
+	}
+	sb.WriteByte(']')
+	return sb.String(), nil
+}
+
+func (v *Vector) Scan(src interface{}) error {
+	var text string
+	switch value := src.(type) {
+	case nil:
+		*v = nil
+		return nil
+	case string:
+		text = value
+	case []byte:
+		text = string(value)
+	default:
+		return fmt.Errorf("cannot scan %T into Vector", src)
+	}
+
+	text = strings.TrimSpace(text)
+	text = strings.TrimPrefix(text, "[")
+	text = strings.TrimSuffix(text, "]")
+	if text == "" {
+		*v = Vector{}
+		return nil
+	}
+
+	parts := strings.Split(text, ",")
+	result := make(Vector, len(parts))
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 32)
+		if err != nil {
+			return fmt.Errorf("invalid vector component %q: %w", part, err)
+		}
+		result[i] = float32(f)
+	}
+	*v = result
+	return nil
+}
+
 func (User) TableName() string {
 	return "User"
 }
@@ -93,6 +362,12 @@ func (SRSCardMetadata) TableName() string {
 // API request/response models
 type ProcessStudySessionRequest struct {
 	SessionID string `json:"sessionId" binding:"required"`
+	// Priority is "interactive" (default) or "batch"
+	Priority string `json:"priority" binding:"omitempty,oneof=interactive batch"`
+	// DueOnly limits the session to cards in the user's due queue
+	DueOnly *bool `json:"dueOnly"`
+	// TimeZone is the IANA time zone whose day the due queue covers
+	TimeZone *string `json:"tz"`
 }
 
 type StudySessionStatusResponse struct {
@@ -100,6 +375,143 @@ type StudySessionStatusResponse struct {
 	Status      string     `json:"status"`
 	CardCount   int        `json:"cardCount"`
 	CompletedAt *time.Time `json:"completedAt"`
+	// QueuePosition is 1 for the next job to run; nil unless the session is queued
+	QueuePosition *int       `json:"queuePosition,omitempty"`
+	Attempt       int        `json:"attempt"`
+	NextRetryAt   *time.Time `json:"nextRetryAt,omitempty"`
+	Provider      *string    `json:"provider,omitempty"`
+	Model         *string    `json:"model,omitempty"`
+	UsedFallback  bool       `json:"usedFallback"`
+	ErrorCode     *string    `json:"errorCode,omitempty"`
+	FailureReason *string    `json:"failureReason,omitempty"`
+}
+
+// StudySessionCardsResponse is one page of a session's cards in study order
+type StudySessionCardsResponse struct {
+	SessionID string                     `json:"sessionId"`
+	Cards     []StudySessionCardResponse `json:"cards"`
+	Total     int64                      `json:"total"`
+	Limit     int                        `json:"limit"`
+	Offset    int                        `json:"offset"`
+}
+
+type StudySessionCardResponse struct {
+	Order          int                  `json:"order"`
+	FlashcardID    string               `json:"flashcardId"`
+	Front          string               `json:"front"`
+	Back           string               `json:"back"`
+	Reason         *string              `json:"reason"`
+	SelectionScore *float64             `json:"selectionScore"`
+	IsRepeat       bool                 `json:"isRepeat"`
+	Metadata       *SRSMetadataResponse `json:"metadata"`
+}
+
+// SRSMetadataResponse is the requesting user's review history for a card;
+// nil for cards they have not reviewed
+type SRSMetadataResponse struct {
+	EaseFactor       float64    `json:"easeFactor"`
+	Interval         int64      `json:"interval"`
+	Repetitions      int        `json:"repetitions"`
+	LastReviewed     *time.Time `json:"lastReviewed"`
+	NextReview       *time.Time `json:"nextReview"`
+	EasyReviewCount  int        `json:"easyReviewCount"`
+	HardReviewCount  int        `json:"hardReviewCount"`
+	AgainReviewCount int        `json:"againReviewCount"`
+	Stability        *float64   `json:"stability"`
+	Difficulty       *float64   `json:"difficulty"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" binding:"required,max=100"`
+	Scopes    []string   `json:"scopes" binding:"required,min=1"` // each one of APIKeyScopes
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type APIKeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// CreateAPIKeyResponse includes the full key, which is only ever shown once
+type CreateAPIKeyResponse struct {
+	APIKeyResponse
+	Key string `json:"key"`
+}
+
+// SubmitReviewRequest records one review of a card. StudySessionID is set
+// when the review happened in a generated study session.
+type SubmitReviewRequest struct {
+	FlashcardID    string  `json:"cardId" binding:"required"`
+	Grade          string  `json:"grade" binding:"required,oneof=again hard good easy"`
+	StudySessionID *string `json:"studySessionId"`
+	// ResponseTimeMs is how long the user took to answer, if measured
+	ResponseTimeMs *int `json:"responseTimeMs" binding:"omitempty,min=0"`
+}
+
+// PreferencesRequest updates the fields that are set
+type PreferencesRequest struct {
+	Scheduler      string `json:"scheduler" binding:"omitempty,oneof=sm2 fsrs"`
+	NewCardsPerDay *int   `json:"newCardsPerDay" binding:"omitempty,min=0,max=1000"`
+	ReviewsPerDay  *int   `json:"reviewsPerDay" binding:"omitempty,min=0,max=10000"`
+}
+
+type PreferencesResponse struct {
+	Scheduler      string `json:"scheduler"`
+	NewCardsPerDay int    `json:"newCardsPerDay"`
+	ReviewsPerDay  int    `json:"reviewsPerDay"`
+}
+
+// DueQueue is what a user should study today: reviewed cards that are due,
+// most overdue first, followed by new cards, both within the daily limits
+type DueQueue struct {
+	Reviews []CardWithMetadata
+	New     []CardWithMetadata
+	// Totals before the daily limits are applied
+	ReviewsDue   int64
+	NewAvailable int64
+	// Cards already reviewed or introduced today count against the limits
+	ReviewedToday   int64
+	IntroducedToday int64
+	ReviewLimit     int
+	NewLimit        int
+}
+
+type DueCardsResponse struct {
+	DeckID          string            `json:"deckId,omitempty"`
+	Cards           []DueCardResponse `json:"cards"`
+	ReviewCount     int               `json:"reviewCount"`
+	NewCount        int               `json:"newCount"`
+	ReviewsDue      int64             `json:"reviewsDue"`
+	NewAvailable    int64             `json:"newAvailable"`
+	ReviewedToday   int64             `json:"reviewedToday"`
+	IntroducedToday int64             `json:"introducedToday"`
+	ReviewLimit     int               `json:"reviewLimit"`
+	NewLimit        int               `json:"newLimit"`
+}
+
+type DueCardResponse struct {
+	FlashcardID string               `json:"cardId"`
+	DeckID      string               `json:"deckId"`
+	Front       string               `json:"front"`
+	Back        string               `json:"back"`
+	IsNew       bool                 `json:"isNew"`
+	DueAt       *time.Time           `json:"dueAt"`
+	OverdueDays float64              `json:"overdueDays"`
+	Metadata    *SRSMetadataResponse `json:"metadata"`
+}
+
+type SubmitReviewResponse struct {
+	FlashcardID    string              `json:"cardId"`
+	Grade          string              `json:"grade"`
+	Scheduler      string              `json:"scheduler"`
+	StudySessionID *string             `json:"studySessionId,omitempty"`
+	Metadata       SRSMetadataResponse `json:"metadata"`
 }
 
 // RAG processing models
@@ -110,14 +522,42 @@ type CardWithMetadata struct {
 
 type CardScore struct {
 	Card          Flashcard
+	Metadata      *SRSCardMetadata
 	WeaknessScore float64
 	SemanticScore float64
+	LexicalScore  float64
 	CombinedScore float64
 }
 
+// CardSelectionResult is a generated card selection and how it was made
+type CardSelectionResult struct {
+	Selections []CardSelection
+	// Provider and Model are empty when the fallback selector was used
+	Provider     string
+	Model        string
+	UsedFallback bool
+}
+
+// CardSelection is one entry of a generated study session
+type CardSelection struct {
+	CardID   string
+	Reason   string
+	Priority int
+	// Repeat marks a second appearance of a card already in the session
+	Repeat bool
+	// Score is the card's combined ranking score
+	Score float64
+}
+
+type CardSimilarity struct {
+	FlashcardID string
+	Similarity  float64
+}
+
 type RAGResult struct {
 	SelectedCards []CardScore
 	TotalCards    int
 	WeakCards     int
 	SemanticCards int
+	LexicalCards  int
 }
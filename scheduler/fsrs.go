@@ -0,0 +1,196 @@
+package scheduler
+
+import (
+	"math"
+	"time"
+)
+
+// DefaultFSRSWeights are the FSRS-4.5 default parameters
+var DefaultFSRSWeights = [17]float64{
+	0.4872, 1.4003, 3.7145, 13.8206, 5.1618, 1.2298, 0.8975, 0.031,
+	1.6474, 0.1367, 1.0461, 2.1072, 0.0793, 0.3246, 1.587, 0.2272, 2.8755,
+}
+
+// Forgetting curve constants of FSRS-4.5: R(t, S) = (1 + factor*t/S)^decay,
+// chosen so that R(S, S) = 0.9
+const (
+	fsrsDecay  = -0.5
+	fsrsFactor = 19.0 / 81.0
+)
+
+const maxIntervalDays = 36500
+
+// FSRS schedules reviews with the Free Spaced Repetition Scheduler. A card's
+// memory is modelled by its stability S (days until recall probability
+// drops to 90%) and difficulty D (1 to 10); the next review is planned for
+// when the probability of recall falls to DesiredRetention.
+type FSRS struct {
+	Weights          [17]float64
+	DesiredRetention float64
+}
+
+// NewFSRS returns FSRS with the default parameters and 90% retention
+func NewFSRS() FSRS {
+	return FSRS{
+		Weights:          DefaultFSRSWeights,
+		DesiredRetention: 0.9,
+	}
+}
+
+func (FSRS) Name() string {
+	return NameFSRS
+}
+
+// Version is "fsrs-4.5" with the default weights and retention, and marked
+// custom otherwise
+func (f FSRS) Version() string {
+	if f.Weights != DefaultFSRSWeights || f.DesiredRetention != 0.9 {
+		return "fsrs-4.5-custom"
+	}
+	return "fsrs-4.5"
+}
+
+// Review returns the state after a review with the given grade at now
+func (f FSRS) Review(state State, grade Grade, now time.Time) State {
+	w := f.Weights
+	rating := fsrsRating(grade)
+
+	if state.Stability <= 0 && state.Repetitions >= 0 && state.LastReviewed != nil {
+		state.Stability, state.Difficulty = f.InitialState(state)
+	}
+
+	if state.Stability <= 0 {
+		// First review: stability and difficulty depend only on the grade
+		state.Stability = w[rating-1]
+		state.Difficulty = f.initialDifficulty(rating)
+	} else {
+		r := f.Retrievability(state, now)
+		difficulty := f.nextDifficulty(state.Difficulty, rating)
+		if grade == Again {
+			state.Stability = f.forgetStability(state.Difficulty, state.Stability, r)
+		} else {
+			state.Stability = f.recallStability(state.Difficulty, state.Stability, r, grade)
+		}
+		state.Difficulty = difficulty
+	}
+
+	if state.Repetitions < 0 {
+		// Keep the SM-2 fields usable in case the user switches back
+		state.EaseFactor = InitialEaseFactor
+		state.Repetitions = 0
+	}
+	if grade == Again {
+		state.Repetitions = 0
+	} else {
+		state.Repetitions++
+	}
+	state.Interval = f.interval(state.Stability)
+
+	reviewed := now
+	next := now.AddDate(0, 0, int(state.Interval))
+	state.LastReviewed = &reviewed
+	state.NextReview = &next
+	return state
+}
+
+// Retrievability is the probability of recalling the card at now. Cards
+// without FSRS state or never reviewed return 0.
+func (f FSRS) Retrievability(state State, now time.Time) float64 {
+	if state.Stability <= 0 || state.LastReviewed == nil {
+		return 0
+	}
+	elapsed := now.Sub(*state.LastReviewed).Hours() / 24
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Pow(1+fsrsFactor*elapsed/state.Stability, fsrsDecay)
+}
+
+// InitialState estimates stability and difficulty for a card reviewed
+// before FSRS was used. Stability is taken to be the current SM-2 interval,
+// which SM-2 sets to roughly where recall drops to 90%. Difficulty starts at
+// the FSRS value for a "good" first answer and moves up with the share of
+// again and hard answers and down with the share of easy ones.
+func (f FSRS) InitialState(state State) (float64, float64) {
+	w := f.Weights
+
+	stability := math.Max(float64(state.Interval), w[0])
+
+	difficulty := f.initialDifficulty(3)
+	graded := state.AgainCount + state.HardCount + state.EasyCount
+	if graded > 0 {
+		shift := float64(2*state.AgainCount+state.HardCount-state.EasyCount) / float64(graded)
+		difficulty += w[5] * shift
+	}
+	return stability, clampDifficulty(difficulty)
+}
+
+func (f FSRS) initialDifficulty(rating int) float64 {
+	w := f.Weights
+	return clampDifficulty(w[4] - float64(rating-3)*w[5])
+}
+
+// nextDifficulty moves difficulty by the grade, then reverts it towards the
+// initial difficulty of a "good" answer
+func (f FSRS) nextDifficulty(difficulty float64, rating int) float64 {
+	w := f.Weights
+	next := difficulty - w[6]*float64(rating-3)
+	return clampDifficulty(w[7]*f.initialDifficulty(3) + (1-w[7])*next)
+}
+
+func (f FSRS) recallStability(difficulty, stability, r float64, grade Grade) float64 {
+	w := f.Weights
+	hardPenalty, easyBonus := 1.0, 1.0
+	if grade == Hard {
+		hardPenalty = w[15]
+	}
+	if grade == Easy {
+		easyBonus = w[16]
+	}
+	return stability * (1 + math.Exp(w[8])*
+		(11-difficulty)*
+		math.Pow(stability, -w[9])*
+		(math.Exp(w[10]*(1-r))-1)*
+		hardPenalty*easyBonus)
+}
+
+func (f FSRS) forgetStability(difficulty, stability, r float64) float64 {
+	w := f.Weights
+	next := w[11] *
+		math.Pow(difficulty, -w[12]) *
+		(math.Pow(stability+1, w[13]) - 1) *
+		math.Exp(w[14]*(1-r))
+	// Forgetting never makes a memory more stable
+	return math.Min(next, stability)
+}
+
+// interval is the number of days until retrievability falls to the
+// desired retention
+func (f FSRS) interval(stability float64) int64 {
+	days := stability / fsrsFactor * (math.Pow(f.DesiredRetention, 1/fsrsDecay) - 1)
+	interval := int64(math.Round(days))
+	if interval < 1 {
+		interval = 1
+	}
+	if interval > maxIntervalDays {
+		interval = maxIntervalDays
+	}
+	return interval
+}
+
+func fsrsRating(grade Grade) int {
+	switch grade {
+	case Again:
+		return 1
+	case Hard:
+		return 2
+	case Easy:
+		return 4
+	default:
+		return 3
+	}
+}
+
+func clampDifficulty(d float64) float64 {
+	return math.Min(math.Max(d, 1), 10)
+}
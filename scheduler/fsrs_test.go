@@ -0,0 +1,216 @@
+package scheduler
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Expected values follow the FSRS-4.5 reference formulas (py-fsrs 3.x) with
+// the default weights
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestFSRSFirstReview(t *testing.T) {
+	tests := []struct {
+		grade      Grade
+		stability  float64
+		difficulty float64
+		interval   int64
+	}{
+		{Again, 0.4872, 7.6214, 1},
+		{Hard, 1.4003, 6.3916, 1},
+		{Good, 3.7145, 5.1618, 4},
+		{Easy, 13.8206, 3.932, 14},
+	}
+	for _, tt := range tests {
+		got := NewFSRS().Review(State{Repetitions: -1}, tt.grade, testNow)
+		if !approxEqual(got.Stability, tt.stability) || !approxEqual(got.Difficulty, tt.difficulty) {
+			t.Errorf("%s: S = %v, D = %v, want %v and %v", tt.grade, got.Stability, got.Difficulty, tt.stability, tt.difficulty)
+		}
+		if got.Interval != tt.interval {
+			t.Errorf("%s: interval = %d, want %d", tt.grade, got.Interval, tt.interval)
+		}
+		if got.EaseFactor != InitialEaseFactor {
+			t.Errorf("%s: ease factor = %v, want the SM-2 default %v", tt.grade, got.EaseFactor, InitialEaseFactor)
+		}
+	}
+}
+
+func TestFSRSRetrievability(t *testing.T) {
+	f := NewFSRS()
+	reviewed := testNow
+	state := State{Stability: 3.7145, Difficulty: 5.1618, LastReviewed: &reviewed}
+
+	tests := []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 1},
+		// Stability is the time until recall drops to 90%
+		{time.Duration(3.7145 * 24 * float64(time.Hour)), 0.9},
+		{4 * 24 * time.Hour, 0.8934995006528037},
+		{3650 * 24 * time.Hour, 0.06572481979051588},
+	}
+	for _, tt := range tests {
+		got := f.Retrievability(state, testNow.Add(tt.elapsed))
+		if math.Abs(got-tt.want) > 1e-5 {
+			t.Errorf("after %v: R = %v, want %v", tt.elapsed, got, tt.want)
+		}
+	}
+
+	if got := f.Retrievability(State{LastReviewed: &reviewed}, testNow); got != 0 {
+		t.Errorf("without FSRS state: R = %v, want 0", got)
+	}
+}
+
+func TestFSRSReview(t *testing.T) {
+	tests := []struct {
+		name       string
+		stability  float64
+		difficulty float64
+		elapsed    int
+		grade      Grade
+		wantS      float64
+		wantD      float64
+		interval   int64
+	}{
+		// Recall stability
+		{"hard", 3.7145, 5.1618, 4, Hard, 6.234966035075983, 6.0314775, 6},
+		{"good", 3.7145, 5.1618, 4, Good, 14.808100506496405, 5.1618, 15},
+		{"easy", 3.7145, 5.1618, 4, Easy, 35.61414825643041, 4.2921225, 36},
+		{"good after overdue", 20, 7, 30, Good, 63.48534291425351, 6.9430158, 63},
+		// Forget stability
+		{"again", 3.7145, 5.1618, 4, Again, 1.4332344897795595, 6.901155, 1},
+		{"again after overdue", 20, 7, 30, Again, 3.8029945227680164, 8.6823708, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reviewed := testNow.AddDate(0, 0, -tt.elapsed)
+			state := State{
+				EaseFactor:   InitialEaseFactor,
+				Interval:     int64(tt.elapsed),
+				Repetitions:  3,
+				LastReviewed: &reviewed,
+				Stability:    tt.stability,
+				Difficulty:   tt.difficulty,
+			}
+
+			got := NewFSRS().Review(state, tt.grade, testNow)
+			if !approxEqual(got.Stability, tt.wantS) || !approxEqual(got.Difficulty, tt.wantD) {
+				t.Errorf("S = %v, D = %v, want %v and %v", got.Stability, got.Difficulty, tt.wantS, tt.wantD)
+			}
+			if got.Interval != tt.interval {
+				t.Errorf("interval = %d, want %d", got.Interval, tt.interval)
+			}
+			if !got.NextReview.Equal(testNow.AddDate(0, 0, int(tt.interval))) {
+				t.Errorf("next review = %v, want %d days after %v", got.NextReview, tt.interval, testNow)
+			}
+			wantReps := 4
+			if tt.grade == Again {
+				wantReps = 0
+			}
+			if got.Repetitions != wantReps {
+				t.Errorf("repetitions = %d, want %d", got.Repetitions, wantReps)
+			}
+		})
+	}
+}
+
+func TestFSRSForgetNeverRaisesStability(t *testing.T) {
+	reviewed := testNow.AddDate(0, 0, -1)
+	state := State{Repetitions: 2, LastReviewed: &reviewed, Stability: 0.5, Difficulty: 3}
+
+	got := NewFSRS().Review(state, Again, testNow)
+	if got.Stability > state.Stability {
+		t.Errorf("stability rose from %v to %v after a lapse", state.Stability, got.Stability)
+	}
+}
+
+func TestFSRSInterval(t *testing.T) {
+	tests := []struct {
+		stability float64
+		retention float64
+		want      int64
+	}{
+		// At 90% retention the interval is the stability
+		{1, 0.9, 1},
+		{3.7145, 0.9, 4},
+		{10, 0.9, 10},
+		{100.4, 0.9, 100},
+		{3.7145, 0.8, 9},
+		{100.4, 0.8, 241},
+		{10, 0.95, 5},
+		{100.4, 0.95, 46},
+		{0.1, 0.9, 1},
+		{1e6, 0.9, maxIntervalDays},
+	}
+	for _, tt := range tests {
+		f := NewFSRS()
+		f.DesiredRetention = tt.retention
+		if got := f.interval(tt.stability); got != tt.want {
+			t.Errorf("interval(%v) at %v = %d, want %d", tt.stability, tt.retention, got, tt.want)
+		}
+	}
+}
+
+func TestFSRSInitialState(t *testing.T) {
+	w := DefaultFSRSWeights
+	goodDifficulty := w[4]
+
+	tests := []struct {
+		name       string
+		state      State
+		stability  float64
+		difficulty float64
+	}{
+		{"no counters", State{Interval: 15}, 15, goodDifficulty},
+		{"short interval uses the again stability", State{Interval: 0}, w[0], goodDifficulty},
+		// Shift of (2*again + hard - easy) / graded
+		{"mostly again", State{Interval: 6, AgainCount: 3, HardCount: 1}, 6, goodDifficulty + w[5]*7/4},
+		{"mixed", State{Interval: 6, AgainCount: 1, HardCount: 1, EasyCount: 2}, 6, goodDifficulty + w[5]*1/4},
+		{"only easy", State{Interval: 40, EasyCount: 5}, 40, goodDifficulty - w[5]},
+		{"clamped", State{Interval: 1, AgainCount: 10}, 1, 7.6214},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stability, difficulty := NewFSRS().InitialState(tt.state)
+			if !approxEqual(stability, tt.stability) || !approxEqual(difficulty, tt.difficulty) {
+				t.Errorf("S = %v, D = %v, want %v and %v", stability, difficulty, tt.stability, tt.difficulty)
+			}
+		})
+	}
+}
+
+func TestFSRSReviewEstimatesSM2State(t *testing.T) {
+	// A card scheduled by SM-2 has no FSRS state; FSRS starts from the
+	// estimate rather than treating it as a first review
+	reviewed := testNow.AddDate(0, 0, -15)
+	state := State{EaseFactor: 2.5, Interval: 15, Repetitions: 3, LastReviewed: &reviewed}
+
+	f := NewFSRS()
+	estimated := state
+	estimated.Stability, estimated.Difficulty = f.InitialState(state)
+
+	got := f.Review(state, Good, testNow)
+	want := f.Review(estimated, Good, testNow)
+	if !approxEqual(got.Stability, want.Stability) || got.Interval != want.Interval {
+		t.Errorf("S = %v, interval %d, want %v and %d", got.Stability, got.Interval, want.Stability, want.Interval)
+	}
+	if got.Stability <= 15 {
+		t.Errorf("stability %v did not grow past the SM-2 interval after a good review", got.Stability)
+	}
+}
+
+func TestFSRSVersion(t *testing.T) {
+	if got := NewFSRS().Version(); got != "fsrs-4.5" {
+		t.Errorf("Version() = %q, want fsrs-4.5", got)
+	}
+	f := NewFSRS()
+	f.DesiredRetention = 0.85
+	if got := f.Version(); got != "fsrs-4.5-custom" {
+		t.Errorf("Version() with custom retention = %q, want fsrs-4.5-custom", got)
+	}
+}
@@ -0,0 +1,161 @@
+// Package scheduler decides when a flashcard is due again after a review
+package scheduler
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Grade is how well the user recalled a card
+type Grade string
+
+const (
+	Again Grade = "again"
+	Hard  Grade = "hard"
+	Good  Grade = "good"
+	Easy  Grade = "easy"
+)
+
+// Valid reports whether g is one of the four grades
+func (g Grade) Valid() bool {
+	return g == Again || g == Hard || g == Good || g == Easy
+}
+
+// State is a card's scheduling state for one user. Interval is in days.
+// Negative Repetitions mark a card that was never reviewed. Stability and
+// Difficulty are FSRS state, zero until the card is first scheduled by FSRS;
+// SM-2 clears them, as they no longer describe the card once it reschedules
+// it, and FSRS estimates them again from the SM-2 state.
+type State struct {
+	EaseFactor   float64
+	Interval     int64
+	Repetitions  int
+	LastReviewed *time.Time
+	NextReview   *time.Time
+
+	Stability  float64
+	Difficulty float64
+
+	// Review counters, used to estimate FSRS state for cards reviewed
+	// before FSRS was used
+	AgainCount int
+	HardCount  int
+	EasyCount  int
+}
+
+// SM-2 constants from the original SuperMemo 2 description
+const (
+	InitialEaseFactor = 2.5
+	MinEaseFactor     = 1.3
+)
+
+// Scheduler computes a card's next state after a review
+type Scheduler interface {
+	// Name identifies the scheduler in user preferences
+	Name() string
+	// Version identifies the algorithm and parameters in the review log
+	Version() string
+	Review(state State, grade Grade, now time.Time) State
+}
+
+// Scheduler names accepted in user preferences
+const (
+	NameSM2  = "sm2"
+	NameFSRS = "fsrs"
+)
+
+// Default is used for users who have not picked a scheduler
+const Default = NameSM2
+
+// ByName returns the scheduler with the given name, with default parameters
+func ByName(name string) (Scheduler, error) {
+	switch name {
+	case NameSM2:
+		return SM2{}, nil
+	case NameFSRS:
+		return NewFSRS(), nil
+	default:
+		return nil, fmt.Errorf("unknown scheduler %q", name)
+	}
+}
+
+// NewState is the state of a card that was never reviewed
+func NewState() State {
+	return State{
+		EaseFactor:  InitialEaseFactor,
+		Interval:    0,
+		Repetitions: 0,
+	}
+}
+
+// SM2 schedules reviews with the SuperMemo 2 algorithm. The four grades map
+// to SM-2 quality 1 (again), 3 (hard), 4 (good) and 5 (easy).
+type SM2 struct{}
+
+func (SM2) Name() string {
+	return NameSM2
+}
+
+func (SM2) Version() string {
+	return "sm2"
+}
+
+// Review returns the state after a review with the given grade at now
+func (SM2) Review(state State, grade Grade, now time.Time) State {
+	if state.Repetitions < 0 {
+		state.EaseFactor = InitialEaseFactor
+		state.Interval = 0
+		state.Repetitions = 0
+	}
+	if state.EaseFactor < MinEaseFactor {
+		state.EaseFactor = MinEaseFactor
+	}
+
+	quality := sm2Quality(grade)
+	if quality < 3 {
+		// A lapse restarts the repetitions without changing the ease factor
+		state.Repetitions = 0
+		state.Interval = 1
+	} else {
+		switch state.Repetitions {
+		case 0:
+			state.Interval = 1
+		case 1:
+			state.Interval = 6
+		default:
+			state.Interval = int64(math.Round(float64(state.Interval) * state.EaseFactor))
+		}
+		state.Repetitions++
+
+		q := float64(5 - quality)
+		state.EaseFactor += 0.1 - q*(0.08+q*0.02)
+		if state.EaseFactor < MinEaseFactor {
+			state.EaseFactor = MinEaseFactor
+		}
+	}
+	if state.Interval < 1 {
+		state.Interval = 1
+	}
+	state.Stability = 0
+	state.Difficulty = 0
+
+	reviewed := now
+	next := now.AddDate(0, 0, int(state.Interval))
+	state.LastReviewed = &reviewed
+	state.NextReview = &next
+	return state
+}
+
+func sm2Quality(grade Grade) int {
+	switch grade {
+	case Again:
+		return 1
+	case Hard:
+		return 3
+	case Easy:
+		return 5
+	default:
+		return 4
+	}
+}
@@ -0,0 +1,118 @@
+package scheduler
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+
+func TestSM2Intervals(t *testing.T) {
+	state := NewState()
+	now := testNow
+
+	// 1 day, 6 days, then the previous interval times the ease factor, which
+	// good answers leave at 2.5
+	for i, want := range []int64{1, 6, 15, 38, 95, 238} {
+		state = SM2{}.Review(state, Good, now)
+		if state.Interval != want {
+			t.Fatalf("review %d: interval = %d, want %d", i+1, state.Interval, want)
+		}
+		if state.Repetitions != i+1 {
+			t.Errorf("review %d: repetitions = %d, want %d", i+1, state.Repetitions, i+1)
+		}
+		if state.EaseFactor != InitialEaseFactor {
+			t.Errorf("review %d: ease factor = %v, want %v", i+1, state.EaseFactor, InitialEaseFactor)
+		}
+		if !state.LastReviewed.Equal(now) || !state.NextReview.Equal(now.AddDate(0, 0, int(want))) {
+			t.Errorf("review %d: reviewed %v, next %v", i+1, state.LastReviewed, state.NextReview)
+		}
+		now = *state.NextReview
+	}
+}
+
+func TestSM2IntervalUsesEaseFactor(t *testing.T) {
+	state := State{EaseFactor: 1.9, Interval: 10, Repetitions: 3}
+	got := SM2{}.Review(state, Good, testNow)
+	if want := int64(math.Round(10 * 1.9)); got.Interval != want {
+		t.Errorf("interval = %d, want %d", got.Interval, want)
+	}
+}
+
+func TestSM2EaseFactorByGrade(t *testing.T) {
+	tests := []struct {
+		grade Grade
+		ease  float64
+		want  float64
+	}{
+		{Easy, 2.5, 2.6},
+		{Good, 2.5, 2.5},
+		{Hard, 2.5, 2.36},
+		// Lapses leave the ease factor alone
+		{Again, 2.5, 2.5},
+		{Hard, 1.4, MinEaseFactor},
+		{Hard, MinEaseFactor, MinEaseFactor},
+		{Again, MinEaseFactor, MinEaseFactor},
+		// Values below the floor, from older data, are raised to it
+		{Good, 1.1, MinEaseFactor},
+	}
+	for _, tt := range tests {
+		state := State{EaseFactor: tt.ease, Interval: 6, Repetitions: 2}
+		got := SM2{}.Review(state, tt.grade, testNow)
+		if math.Abs(got.EaseFactor-tt.want) > 1e-9 {
+			t.Errorf("%s from %v: ease factor = %v, want %v", tt.grade, tt.ease, got.EaseFactor, tt.want)
+		}
+	}
+}
+
+func TestSM2LapseResetsRepetitions(t *testing.T) {
+	state := State{EaseFactor: 2.2, Interval: 40, Repetitions: 5}
+
+	state = SM2{}.Review(state, Again, testNow)
+	if state.Repetitions != 0 || state.Interval != 1 {
+		t.Fatalf("after a lapse: repetitions = %d, interval = %d, want 0 and 1", state.Repetitions, state.Interval)
+	}
+	if !state.NextReview.Equal(testNow.AddDate(0, 0, 1)) {
+		t.Errorf("next review = %v, want a day later", state.NextReview)
+	}
+
+	// The card then climbs back through 1 and 6 days
+	state = SM2{}.Review(state, Good, testNow)
+	if state.Repetitions != 1 || state.Interval != 1 {
+		t.Errorf("first review after a lapse: repetitions = %d, interval = %d, want 1 and 1", state.Repetitions, state.Interval)
+	}
+	state = SM2{}.Review(state, Good, testNow)
+	if state.Repetitions != 2 || state.Interval != 6 {
+		t.Errorf("second review after a lapse: repetitions = %d, interval = %d, want 2 and 6", state.Repetitions, state.Interval)
+	}
+}
+
+func TestSM2ResetsNewCard(t *testing.T) {
+	// The Prisma default row for a card that was never reviewed
+	state := State{EaseFactor: 1.3, Interval: 12, Repetitions: -1}
+
+	got := SM2{}.Review(state, Good, testNow)
+	if got.EaseFactor != InitialEaseFactor {
+		t.Errorf("ease factor = %v, want %v", got.EaseFactor, InitialEaseFactor)
+	}
+	if got.Repetitions != 1 || got.Interval != 1 {
+		t.Errorf("repetitions = %d, interval = %d, want 1 and 1", got.Repetitions, got.Interval)
+	}
+
+	got = SM2{}.Review(state, Easy, testNow)
+	if math.Abs(got.EaseFactor-2.6) > 1e-9 {
+		t.Errorf("easy first review: ease factor = %v, want 2.6", got.EaseFactor)
+	}
+}
+
+func TestSM2ClearsFSRSState(t *testing.T) {
+	// FSRS state is out of date once SM-2 changes the interval
+	reviewed := testNow.AddDate(0, 0, -15)
+	state := State{EaseFactor: 2.5, Interval: 15, Repetitions: 3, LastReviewed: &reviewed, Stability: 1, Difficulty: 6}
+
+	got := SM2{}.Review(state, Good, testNow)
+	if got.Stability != 0 || got.Difficulty != 0 {
+		t.Errorf("S = %v, D = %v after an SM-2 review, want 0", got.Stability, got.Difficulty)
+	}
+}
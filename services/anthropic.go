@@ -0,0 +1,148 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"memoriva-backend/config"
+	"net/http"
+	"strings"
+)
+
+const anthropicAPIVersion = "2023-06-01"
+
+// anthropicProvider talks to the Anthropic Messages API
+type anthropicProvider struct {
+	name         string
+	model        string
+	promptBudget int
+	baseURL      string
+	apiKey       string
+	client       *http.Client
+}
+
+func newAnthropicProvider(providerConfig config.LLMProviderConfig) *anthropicProvider {
+	return &anthropicProvider{
+		name:         providerConfig.Name,
+		model:        providerConfig.Model,
+		promptBudget: providerConfig.PromptTokens,
+		baseURL:      strings.TrimSuffix(providerConfig.BaseURL, "/"),
+		apiKey:       providerConfig.APIKey,
+		client:       &http.Client{Timeout: providerConfig.Timeout},
+	}
+}
+
+func (p *anthropicProvider) Name() string {
+	return p.name
+}
+
+func (p *anthropicProvider) Model() string {
+	return p.model
+}
+
+func (p *anthropicProvider) PromptBudget() int {
+	return p.promptBudget
+}
+
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	MaxTokens   int                `json:"max_tokens"`
+	Temperature float32            `json:"temperature"`
+}
+
+type anthropicResponse struct {
+	Model   string `json:"model"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *anthropicProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	body := anthropicRequest{
+		Model:       p.model,
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
+	}
+
+	// System prompts are a top-level field rather than a message role
+	var system []string
+	for _, message := range req.Messages {
+		if message.Role == ChatRoleSystem {
+			system = append(system, message.Content)
+			continue
+		}
+		body.Messages = append(body.Messages, anthropicMessage{Role: message.Role, Content: message.Content})
+	}
+	body.System = strings.Join(system, "\n\n")
+
+	// Prefill the reply so structured requests start directly with the JSON object
+	prefill := ""
+	if req.ResponseSchema != nil {
+		prefill = "{"
+		body.Messages = append(body.Messages, anthropicMessage{Role: ChatRoleAssistant, Content: prefill})
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/v1/messages", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", p.apiKey)
+	httpReq.Header.Set("anthropic-version", anthropicAPIVersion)
+
+	httpResp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp anthropicResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response from %s (status %d): %w", p.name, httpResp.StatusCode, err)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		message := http.StatusText(httpResp.StatusCode)
+		if resp.Error != nil {
+			message = resp.Error.Message
+		}
+		return nil, &ProviderHTTPError{StatusCode: httpResp.StatusCode, Message: message}
+	}
+
+	var text strings.Builder
+	text.WriteString(prefill)
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+
+	return &ChatResponse{
+		Content: text.String(),
+		Model:   resp.Model,
+	}, nil
+}
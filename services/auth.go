@@ -0,0 +1,249 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"memoriva-backend/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrUnauthenticated is returned when a request carries no valid session
+// token or the token's user does not exist
+var ErrUnauthenticated = fmt.Errorf("unauthenticated")
+
+// Cookies NextAuth v4 and Auth.js v5 store the session token in. The
+// __Secure- variants are used when the frontend is served over HTTPS.
+var sessionCookieNames = []string{
+	"__Secure-authjs.session-token",
+	"authjs.session-token",
+	"__Secure-next-auth.session-token",
+	"next-auth.session-token",
+}
+
+type AuthConfig struct {
+	// Secret shared with the frontend (NEXTAUTH_SECRET). Used to decrypt
+	// JWE session tokens and to verify HS256 tokens.
+	Secret string
+	// JWKS URL publishing the keys for RS256/ES256 tokens
+	JWKSURL  string
+	Issuer   string
+	Audience string
+}
+
+// AuthService verifies NextAuth session tokens and personal API keys and
+// resolves them to users
+type AuthService struct {
+	dbService *DatabaseService
+	config    AuthConfig
+	jwks      *jwksCache
+}
+
+func NewAuthService(dbService *DatabaseService, config AuthConfig) *AuthService {
+	service := &AuthService{
+		dbService: dbService,
+		config:    config,
+	}
+	if config.JWKSURL != "" {
+		service.jwks = newJWKSCache(config.JWKSURL)
+	}
+	return service
+}
+
+// Configured reports whether any way of verifying tokens is set up
+func (s *AuthService) Configured() bool {
+	return s.config.Secret != "" || s.jwks != nil
+}
+
+// Authenticate verifies the session token sent as a bearer token or a
+// NextAuth session cookie and returns the user it belongs to
+func (s *AuthService) Authenticate(ctx context.Context, r *http.Request) (*models.User, error) {
+	token, cookieName := sessionToken(r)
+	if token == "" {
+		return nil, ErrUnauthenticated
+	}
+
+	claims, err := s.verify(ctx, token, cookieName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	if claims.Subject == "" && claims.Email == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrUnauthenticated)
+	}
+
+	user, err := s.dbService.GetUser(ctx, claims.Subject, claims.Email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: unknown user", ErrUnauthenticated)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Personal API keys look like mrv_<prefix>_<secret>. The prefix is stored in
+// the clear to find the key; the whole key is stored hashed.
+const apiKeyPrefix = "mrv_"
+
+// CreateAPIKey issues a new key for the user and returns it along with the
+// full key, which is not stored and cannot be shown again
+func (s *AuthService) CreateAPIKey(ctx context.Context, userID, name string, scopes []string, expiresAt *time.Time) (*models.APIKey, string, error) {
+	prefix := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	key := &models.APIKey{
+		ID:        generateUUID(),
+		UserID:    userID,
+		Name:      name,
+		Prefix:    hex.EncodeToString(prefix),
+		Scopes:    strings.Join(scopes, ","),
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}
+	raw := apiKeyPrefix + key.Prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	key.SecretHash = hashAPIKey(raw)
+
+	if err := s.dbService.CreateAPIKey(ctx, key); err != nil {
+		return nil, "", err
+	}
+	return key, raw, nil
+}
+
+// AuthenticateAPIKey checks a key sent in the x-api-key header and returns
+// its owner and the key itself, whose scopes limit what the request may do
+func (s *AuthService) AuthenticateAPIKey(ctx context.Context, raw string) (*models.User, *models.APIKey, error) {
+	rest, ok := strings.CutPrefix(raw, apiKeyPrefix)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: malformed API key", ErrUnauthenticated)
+	}
+	prefix, _, ok := strings.Cut(rest, "_")
+	if !ok || prefix == "" {
+		return nil, nil, fmt.Errorf("%w: malformed API key", ErrUnauthenticated)
+	}
+
+	key, err := s.dbService.GetAPIKeyByPrefix(ctx, prefix)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, fmt.Errorf("%w: unknown API key", ErrUnauthenticated)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(raw)), []byte(key.SecretHash)) != 1 {
+		return nil, nil, fmt.Errorf("%w: unknown API key", ErrUnauthenticated)
+	}
+	if key.RevokedAt != nil {
+		return nil, nil, fmt.Errorf("%w: API key revoked", ErrUnauthenticated)
+	}
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		return nil, nil, fmt.Errorf("%w: API key expired", ErrUnauthenticated)
+	}
+
+	user, err := s.dbService.GetUser(ctx, key.UserID, "")
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, fmt.Errorf("%w: unknown user", ErrUnauthenticated)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Failing to record the use must not fail the request
+	if err := s.dbService.TouchAPIKey(ctx, key.ID); err != nil {
+		log.Printf("Failed to record use of API key %s: %v", key.ID, err)
+	}
+
+	return user, key, nil
+}
+
+func hashAPIKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// verify decrypts or checks the signature of a token and validates its
+// claims. Encrypted bearer tokens do not say which cookie they came from,
+// so every Auth.js cookie name is tried as the key salt.
+func (s *AuthService) verify(ctx context.Context, token, cookieName string) (*tokenClaims, error) {
+	var payload []byte
+	var err error
+
+	switch strings.Count(token, ".") {
+	case 4:
+		if s.config.Secret == "" {
+			return nil, fmt.Errorf("encrypted tokens are not accepted without a shared secret")
+		}
+		salts := []string{cookieName}
+		if cookieName == "" {
+			salts = sessionCookieNames
+		}
+		for _, salt := range salts {
+			payload, err = decryptNextAuthJWE(token, s.config.Secret, salt)
+			if err == nil {
+				break
+			}
+		}
+	case 2:
+		payload, err = verifyJWS(ctx, token, s.config.Secret, s.jwks)
+	default:
+		err = fmt.Errorf("malformed token")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	if err := claims.validate(s.config.Issuer, s.config.Audience, time.Now()); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// sessionToken returns the bearer token, or else the session cookie and its
+// name. NextAuth splits cookies over 4KB into name.0, name.1, ...
+func sessionToken(r *http.Request) (string, string) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+			return strings.TrimSpace(token), ""
+		}
+	}
+
+	for _, name := range sessionCookieNames {
+		if cookie, err := r.Cookie(name); err == nil && cookie.Value != "" {
+			return cookie.Value, name
+		}
+
+		var chunks strings.Builder
+		for i := 0; ; i++ {
+			cookie, err := r.Cookie(name + "." + strconv.Itoa(i))
+			if err != nil {
+				break
+			}
+			chunks.WriteString(cookie.Value)
+		}
+		if chunks.Len() > 0 {
+			return chunks.String(), name
+		}
+	}
+
+	return "", ""
+}
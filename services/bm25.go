@@ -0,0 +1,88 @@
+package services
+
+import (
+	"math"
+	"memoriva-backend/models"
+)
+
+// Standard BM25 parameters: k1 controls term frequency saturation and b the
+// strength of document length normalisation
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// BM25Index scores flashcards against keyword queries using their Front and Back text
+type BM25Index struct {
+	cardIDs   []string
+	termFreqs []map[string]int
+	lengths   []int
+	docFreqs  map[string]int
+	avgLength float64
+}
+
+func NewBM25Index(cards []models.Flashcard) *BM25Index {
+	index := &BM25Index{
+		cardIDs:   make([]string, len(cards)),
+		termFreqs: make([]map[string]int, len(cards)),
+		lengths:   make([]int, len(cards)),
+		docFreqs:  make(map[string]int),
+	}
+
+	totalLength := 0
+	for i, card := range cards {
+		terms := tokenize(card.Front + " " + card.Back)
+		freqs := make(map[string]int, len(terms))
+		for _, term := range terms {
+			freqs[term]++
+		}
+		for term := range freqs {
+			index.docFreqs[term]++
+		}
+
+		index.cardIDs[i] = card.ID
+		index.termFreqs[i] = freqs
+		index.lengths[i] = len(terms)
+		totalLength += len(terms)
+	}
+
+	if len(cards) > 0 {
+		index.avgLength = float64(totalLength) / float64(len(cards))
+	}
+
+	return index
+}
+
+// Score returns the BM25 score of every card matching at least one query
+// term, keyed by card ID
+func (idx *BM25Index) Score(query string) map[string]float64 {
+	scores := make(map[string]float64)
+	if idx.avgLength == 0 {
+		return scores
+	}
+
+	queryTerms := make(map[string]bool)
+	for _, term := range tokenize(query) {
+		queryTerms[term] = true
+	}
+
+	n := float64(len(idx.cardIDs))
+	for term := range queryTerms {
+		df := idx.docFreqs[term]
+		if df == 0 {
+			continue
+		}
+		idf := math.Log(1 + (n-float64(df)+0.5)/(float64(df)+0.5))
+
+		for i, freqs := range idx.termFreqs {
+			tf := float64(freqs[term])
+			if tf == 0 {
+				continue
+			}
+			norm := tf + bm25K1*(1-bm25B+bm25B*float64(idx.lengths[i])/idx.avgLength)
+			scores[idx.cardIDs[i]] += idf * tf * (bm25K1 + 1) / norm
+		}
+	}
+
+	return scores
+}
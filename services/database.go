@@ -1,11 +1,19 @@
 package services
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"memoriva-backend/models"
+	"memoriva-backend/scheduler"
+	"sort"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func generateUUID() string {
@@ -13,7 +21,8 @@ func generateUUID() string {
 }
 
 type DatabaseService struct {
-	db *gorm.DB
+	db            *gorm.DB
+	vectorEnabled bool
 }
 
 func InitDatabase(databaseURL string) (*gorm.DB, error) {
@@ -36,18 +45,177 @@ func NewDatabaseService(db *gorm.DB) *DatabaseService {
 	return &DatabaseService{db: db}
 }
 
-func (s *DatabaseService) GetStudySession(sessionID string) (*models.StudySession, error) {
+// Migrate creates the tables owned by this backend. Tables from the Prisma
+// schema are left untouched.
+func (s *DatabaseService) Migrate() error {
+	if err := s.db.Exec("CREATE EXTENSION IF NOT EXISTS vector").Error; err != nil {
+		log.Printf("Could not create pgvector extension: %v", err)
+	}
+
+	var extensions int64
+	if err := s.db.Raw("SELECT COUNT(*) FROM pg_extension WHERE extname = 'vector'").Scan(&extensions).Error; err != nil {
+		return fmt.Errorf("failed to check for pgvector: %w", err)
+	}
+	s.vectorEnabled = extensions > 0
+	if !s.vectorEnabled {
+		log.Println("pgvector not available, using in-process similarity search")
+	}
+
+	// The embedding column type depends on pgvector, so this table is created by hand
+	embeddingType := "text"
+	if s.vectorEnabled {
+		embeddingType = "vector"
+	}
+	err := s.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "CardEmbedding" (
+		"id" text PRIMARY KEY,
+		"flashcardId" text NOT NULL,
+		"model" text NOT NULL,
+		"contentHash" text NOT NULL,
+		"embedding" %s NOT NULL,
+		"updatedAt" timestamptz NOT NULL DEFAULT NOW(),
+		UNIQUE ("flashcardId", "model")
+	)`, embeddingType)).Error
+	if err != nil {
+		return fmt.Errorf("failed to create CardEmbedding table: %w", err)
+	}
+
+	if err := s.db.AutoMigrate(&models.StudySessionJob{}, &models.StudySessionDeadLetter{}, &models.StudySessionResult{}, &models.APIKey{}, &models.UserPreference{}, &models.ReviewLog{}); err != nil {
+		return fmt.Errorf("failed to migrate backend tables: %w", err)
+	}
+
+	// At most one queued or running job per session. Duplicates queued before
+	// this index existed are cancelled, keeping the oldest.
+	err = s.db.Exec(`UPDATE "StudySessionJob" j SET "status" = @cancelled, "lockedBy" = NULL, "lockedUntil" = NULL
+		WHERE j."status" IN @active AND EXISTS (
+			SELECT 1 FROM "StudySessionJob" o
+			WHERE o."sessionId" = j."sessionId" AND o."status" IN @active
+				AND (o."createdAt", o."id") < (j."createdAt", j."id")
+		)`,
+		map[string]interface{}{
+			"cancelled": models.JobStatusCancelled,
+			"active":    []string{models.JobStatusQueued, models.JobStatusRunning},
+		},
+	).Error
+	if err != nil {
+		return fmt.Errorf("failed to cancel duplicate jobs: %w", err)
+	}
+	err = s.db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS "idx_study_session_job_active"
+		ON "StudySessionJob" ("sessionId") WHERE "status" IN ('QUEUED', 'RUNNING')`).Error
+	if err != nil {
+		return fmt.Errorf("failed to create active job index: %w", err)
+	}
+
+	// Jobs queued before per-user fairness have no owner yet
+	err = s.db.Exec(`UPDATE "StudySessionJob" j SET "userId" = s."userId"
+		FROM "StudySession" s
+		WHERE s."id" = j."sessionId" AND j."userId" = ''`).Error
+	if err != nil {
+		return fmt.Errorf("failed to backfill job owners: %w", err)
+	}
+
+	// Columns this backend adds to Prisma-managed tables
+	err = s.db.Exec(`ALTER TABLE "StudySessionCard"
+		ADD COLUMN IF NOT EXISTS "selectionReason" text,
+		ADD COLUMN IF NOT EXISTS "selectionScore" double precision,
+		ADD COLUMN IF NOT EXISTS "isRepeat" boolean NOT NULL DEFAULT false`).Error
+	if err != nil {
+		return fmt.Errorf("failed to add StudySessionCard columns: %w", err)
+	}
+
+	err = s.db.Exec(`ALTER TABLE "SRSCardMetadata"
+		ADD COLUMN IF NOT EXISTS "lastStudySessionId" text,
+		ADD COLUMN IF NOT EXISTS "stability" double precision,
+		ADD COLUMN IF NOT EXISTS "difficulty" double precision,
+		ADD COLUMN IF NOT EXISTS "introducedAt" timestamptz`).Error
+	if err != nil {
+		return fmt.Errorf("failed to add SRSCardMetadata columns: %w", err)
+	}
+
+	err = s.db.Exec(`ALTER TABLE "StudySession"
+		ADD COLUMN IF NOT EXISTS "dueOnly" boolean NOT NULL DEFAULT false,
+		ADD COLUMN IF NOT EXISTS "timeZone" text NOT NULL DEFAULT 'UTC'`).Error
+	if err != nil {
+		return fmt.Errorf("failed to add StudySession columns: %w", err)
+	}
+
+	if err := s.backfillFSRSState(); err != nil {
+		return fmt.Errorf("failed to backfill FSRS state: %w", err)
+	}
+
+	return nil
+}
+
+// GetUser looks a user up by ID, or by email when the ID is empty or unknown
+func (s *DatabaseService) GetUser(ctx context.Context, userID, email string) (*models.User, error) {
+	var user models.User
+	if userID != "" {
+		err := s.db.WithContext(ctx).First(&user, "id = ?", userID).Error
+		if err == nil {
+			return &user, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) || email == "" {
+			return nil, err
+		}
+	}
+
+	err := s.db.WithContext(ctx).First(&user, "email = ?", email).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// backfillFSRSState gives reviewed cards of FSRS users without FSRS state
+// one estimated from their SM-2 interval and review counters, so they keep
+// their history. Other users' cards have their FSRS state cleared, as SM-2
+// does not keep it up to date; FSRS and the weakness model estimate it on
+// the fly from the current interval instead, including for users who switch
+// to FSRS before the next start.
+func (s *DatabaseService) backfillFSRSState() error {
+	fsrsUsers := s.db.Model(&models.UserPreference{}).Select("\"userId\"").Where("scheduler = ?", scheduler.NameFSRS)
+
+	err := s.db.Model(&models.SRSCardMetadata{}).
+		Where("(stability IS NOT NULL OR difficulty IS NOT NULL) AND \"userId\" NOT IN (?)", fsrsUsers).
+		Updates(map[string]interface{}{"stability": nil, "difficulty": nil}).Error
+	if err != nil {
+		return err
+	}
+
+	fsrs := scheduler.NewFSRS()
+	var rows []models.SRSCardMetadata
+
+	return s.db.Where("stability IS NULL AND \"lastReviewed\" IS NOT NULL AND repetitions >= 0 AND \"userId\" IN (?)", fsrsUsers).
+		FindInBatches(&rows, 500, func(tx *gorm.DB, batch int) error {
+			for _, row := range rows {
+				stability, difficulty := fsrs.InitialState(scheduler.State{
+					Interval:    row.Interval,
+					Repetitions: row.Repetitions,
+					AgainCount:  row.AgainReviewCount,
+					HardCount:   row.HardReviewCount,
+					EasyCount:   row.EasyReviewCount,
+				})
+				err := s.db.Model(&models.SRSCardMetadata{}).Where("id = ?", row.ID).
+					Updates(map[string]interface{}{"stability": stability, "difficulty": difficulty}).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+}
+
+func (s *DatabaseService) GetStudySession(ctx context.Context, sessionID string) (*models.StudySession, error) {
 	var session models.StudySession
-	err := s.db.First(&session, "id = ?", sessionID).Error
+	err := s.db.WithContext(ctx).First(&session, "id = ?", sessionID).Error
 	if err != nil {
 		return nil, err
 	}
 	return &session, nil
 }
 
-func (s *DatabaseService) GetDeckCardsWithMetadata(deckID, userID string) ([]models.CardWithMetadata, error) {
+func (s *DatabaseService) GetDeckCardsWithMetadata(ctx context.Context, deckID, userID string) ([]models.CardWithMetadata, error) {
 	var cards []models.Flashcard
-	err := s.db.Where("\"deckId\" = ?", deckID).Find(&cards).Error
+	err := s.db.WithContext(ctx).Where("\"deckId\" = ?", deckID).Find(&cards).Error
 	if err != nil {
 		return nil, err
 	}
@@ -55,7 +223,7 @@ func (s *DatabaseService) GetDeckCardsWithMetadata(deckID, userID string) ([]mod
 	var result []models.CardWithMetadata
 	for _, card := range cards {
 		var metadata models.SRSCardMetadata
-		err := s.db.Where("\"flashcardId\" = ? AND \"userId\" = ?", card.ID, userID).First(&metadata).Error
+		err := s.db.WithContext(ctx).Where("\"flashcardId\" = ? AND \"userId\" = ?", card.ID, userID).First(&metadata).Error
 
 		cardWithMetadata := models.CardWithMetadata{
 			Card: card,
@@ -71,49 +239,1137 @@ func (s *DatabaseService) GetDeckCardsWithMetadata(deckID, userID string) ([]mod
 	return result, nil
 }
 
-func (s *DatabaseService) UpdateStudySessionStatus(sessionID, status string) error {
-	return s.db.Model(&models.StudySession{}).Where("id = ?", sessionID).Update("status", status).Error
+func (s *DatabaseService) UpdateStudySessionStatus(ctx context.Context, sessionID, status string) error {
+	return s.db.WithContext(ctx).Model(&models.StudySession{}).Where("id = ?", sessionID).Update("status", status).Error
 }
 
-func (s *DatabaseService) CreateStudySessionCards(sessionID string, cardIDs []string) error {
-	// First, delete any existing cards for this session to avoid duplicates
-	err := s.db.Where("\"studySessionId\" = ?", sessionID).Delete(&models.StudySessionCard{}).Error
-	if err != nil {
-		return err
+// StartStudySession marks a session PROCESSING unless it was cancelled, in
+// which case it returns ErrSessionCancelled
+func (s *DatabaseService) StartStudySession(ctx context.Context, sessionID string) error {
+	result := s.db.WithContext(ctx).Model(&models.StudySession{}).
+		Where("id = ? AND status <> ?", sessionID, models.SessionStatusCancelled).
+		Update("status", models.SessionStatusProcessing)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSessionCancelled
 	}
+	return nil
+}
 
-	var studySessionCards []models.StudySessionCard
+// CompleteStudySession replaces the session's cards with the selection and
+// marks it READY in one transaction, so a reader never sees a partial set of
+// cards. The session row is locked first, so concurrent completions of the
+// same session run one after the other rather than interleaving their
+// deletes and inserts. The processing result is saved in the same
+// transaction. Returns ErrSessionCancelled if the session was cancelled
+// while its cards were being selected.
+func (s *DatabaseService) CompleteStudySession(ctx context.Context, sessionID string, selections []models.CardSelection, result *models.StudySessionResult) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var session models.StudySession
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&session, "id = ?", sessionID).Error; err != nil {
+			return err
+		}
+		if session.Status == models.SessionStatusCancelled {
+			return ErrSessionCancelled
+		}
 
-	for i, cardID := range cardIDs {
-		studySessionCards = append(studySessionCards, models.StudySessionCard{
-			ID:             generateUUID(),
-			StudySessionID: sessionID,
-			FlashcardID:    cardID,
-			Order:          i + 1,
-		})
-	}
+		// Replace any cards left by an earlier attempt
+		if err := tx.Where("\"studySessionId\" = ?", sessionID).Delete(&models.StudySessionCard{}).Error; err != nil {
+			return err
+		}
+
+		studySessionCards := make([]models.StudySessionCard, 0, len(selections))
+		for i, selection := range selections {
+			var reason *string
+			if selection.Reason != "" {
+				reason = &selection.Reason
+			}
+			score := selection.Score
 
-	return s.db.Create(&studySessionCards).Error
+			studySessionCards = append(studySessionCards, models.StudySessionCard{
+				ID:             generateUUID(),
+				StudySessionID: sessionID,
+				FlashcardID:    selection.CardID,
+				Order:          i + 1,
+				Reason:         reason,
+				Score:          &score,
+				Repeat:         selection.Repeat,
+			})
+		}
+		if len(studySessionCards) > 0 {
+			if err := tx.Create(&studySessionCards).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := saveStudySessionResult(tx, result); err != nil {
+			return err
+		}
+
+		return tx.Model(&session).Updates(map[string]interface{}{
+			"status":      models.SessionStatusReady,
+			"completedAt": gorm.Expr("NOW()"),
+		}).Error
+	})
 }
 
-func (s *DatabaseService) CompleteStudySession(sessionID string) error {
-	return s.db.Model(&models.StudySession{}).Where("id = ?", sessionID).Updates(map[string]interface{}{
-		"status":      "READY",
-		"completedAt": "NOW()",
-	}).Error
+// SaveStudySessionResult records the outcome of a processing attempt,
+// replacing the previous one
+func (s *DatabaseService) SaveStudySessionResult(ctx context.Context, result *models.StudySessionResult) error {
+	return saveStudySessionResult(s.db.WithContext(ctx), result)
+}
+
+func saveStudySessionResult(db *gorm.DB, result *models.StudySessionResult) error {
+	result.UpdatedAt = time.Now()
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "sessionId"}},
+		UpdateAll: true,
+	}).Create(result).Error
+}
+
+// CancelStudySession marks a pending or processing session CANCELLED and
+// cancels its queued or running jobs. A worker running the job notices on its
+// next heartbeat; the caller should also abort it directly when it runs in
+// this process. Returns ErrSessionNotCancellable when the session has
+// already finished.
+func (s *DatabaseService) CancelStudySession(ctx context.Context, sessionID string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var session models.StudySession
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&session, "id = ?", sessionID).Error; err != nil {
+			return err
+		}
+		if session.Status != models.SessionStatusPending && session.Status != models.SessionStatusProcessing {
+			return ErrSessionNotCancellable
+		}
+
+		if err := tx.Model(&session).Update("status", models.SessionStatusCancelled).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&models.StudySessionJob{}).
+			Where("\"sessionId\" = ? AND status IN ?", sessionID, []string{models.JobStatusQueued, models.JobStatusRunning}).
+			Updates(map[string]interface{}{
+				"status":      models.JobStatusCancelled,
+				"lockedBy":    nil,
+				"lockedUntil": nil,
+				"lastError":   "cancelled by user",
+				"updatedAt":   time.Now(),
+			}).Error
+	})
 }
 
-func (s *DatabaseService) GetStudySessionStatus(sessionID string) (*models.StudySessionStatusResponse, error) {
+// GetStudySessionStatus describes a session's progress: its cards once
+// ready, its latest job and, while queued, its position in the queue, and
+// the result of the latest processing attempt
+func (s *DatabaseService) GetStudySessionStatus(ctx context.Context, sessionID string) (*models.StudySessionStatusResponse, error) {
+	db := s.db.WithContext(ctx)
+
 	var session models.StudySession
-	err := s.db.Preload("Cards").First(&session, "id = ?", sessionID).Error
-	if err != nil {
+	if err := db.First(&session, "id = ?", sessionID).Error; err != nil {
 		return nil, err
 	}
 
-	return &models.StudySessionStatusResponse{
+	status := &models.StudySessionStatusResponse{
 		ID:          session.ID,
 		Status:      session.Status,
-		CardCount:   len(session.Cards),
 		CompletedAt: session.CompletedAt,
-	}, nil
+	}
+
+	var cardCount int64
+	if err := db.Model(&models.StudySessionCard{}).Where("\"studySessionId\" = ?", sessionID).Count(&cardCount).Error; err != nil {
+		return nil, err
+	}
+	status.CardCount = int(cardCount)
+
+	var jobs []models.StudySessionJob
+	if err := db.Where("\"sessionId\" = ?", sessionID).Order("\"createdAt\" DESC").Limit(1).Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	if len(jobs) > 0 {
+		job := jobs[0]
+		status.Attempt = job.Attempts
+
+		if job.Status == models.JobStatusQueued {
+			if job.Attempts > 0 {
+				status.NextRetryAt = &job.RunAt
+			}
+
+			// Jobs claimed before this one; per-user fairness can reorder
+			// jobs of equal priority, so this is an estimate
+			var ahead int64
+			err := db.Model(&models.StudySessionJob{}).
+				Where("status = ? AND (priority < ? OR (priority = ? AND \"runAt\" < ?))",
+					models.JobStatusQueued, job.Priority, job.Priority, job.RunAt).
+				Count(&ahead).Error
+			if err != nil {
+				return nil, err
+			}
+			position := int(ahead) + 1
+			status.QueuePosition = &position
+		}
+	}
+
+	var results []models.StudySessionResult
+	if err := db.Where("\"sessionId\" = ?", sessionID).Limit(1).Find(&results).Error; err != nil {
+		return nil, err
+	}
+	if len(results) > 0 {
+		result := results[0]
+		status.Provider = result.Provider
+		status.Model = result.Model
+		status.UsedFallback = result.UsedFallback
+		status.ErrorCode = result.ErrorCode
+		status.FailureReason = result.FailureReason
+		if result.Attempt > status.Attempt {
+			status.Attempt = result.Attempt
+		}
+	}
+
+	return status, nil
+}
+
+// GetStudySessionCards returns one page of the session's cards in study
+// order with their flashcards and the given user's SRS metadata, keyed by
+// flashcard ID, along with the total number of cards
+func (s *DatabaseService) GetStudySessionCards(ctx context.Context, sessionID, userID string, limit, offset int) ([]models.StudySessionCard, map[string]models.SRSCardMetadata, int64, error) {
+	db := s.db.WithContext(ctx)
+
+	var total int64
+	if err := db.Model(&models.StudySessionCard{}).Where("\"studySessionId\" = ?", sessionID).Count(&total).Error; err != nil {
+		return nil, nil, 0, err
+	}
+
+	var cards []models.StudySessionCard
+	err := db.Preload("Flashcard").
+		Where("\"studySessionId\" = ?", sessionID).
+		Order("\"order\"").Limit(limit).Offset(offset).
+		Find(&cards).Error
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	flashcardIDs := make([]string, 0, len(cards))
+	for _, card := range cards {
+		flashcardIDs = append(flashcardIDs, card.FlashcardID)
+	}
+
+	var metadata []models.SRSCardMetadata
+	if len(flashcardIDs) > 0 {
+		err := db.Where("\"flashcardId\" IN ? AND \"userId\" = ?", flashcardIDs, userID).Find(&metadata).Error
+		if err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	byCard := make(map[string]models.SRSCardMetadata, len(metadata))
+	for _, m := range metadata {
+		byCard[m.FlashcardID] = m
+	}
+
+	return cards, byCard, total, nil
+}
+
+// GetCardEmbeddings returns the stored embeddings for the given cards, keyed by flashcard ID
+func (s *DatabaseService) GetCardEmbeddings(ctx context.Context, cardIDs []string, model string) (map[string]models.CardEmbedding, error) {
+	var embeddings []models.CardEmbedding
+	err := s.db.WithContext(ctx).Where("\"flashcardId\" IN ? AND \"model\" = ?", cardIDs, model).Find(&embeddings).Error
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]models.CardEmbedding, len(embeddings))
+	for _, embedding := range embeddings {
+		result[embedding.FlashcardID] = embedding
+	}
+	return result, nil
+}
+
+// SaveCardEmbedding inserts or replaces the embedding for a card and model
+func (s *DatabaseService) SaveCardEmbedding(ctx context.Context, embedding *models.CardEmbedding) error {
+	if embedding.ID == "" {
+		embedding.ID = generateUUID()
+	}
+	embedding.UpdatedAt = time.Now()
+
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "flashcardId"}, {Name: "model"}},
+		DoUpdates: clause.AssignmentColumns([]string{"contentHash", "embedding", "updatedAt"}),
+	}).Create(embedding).Error
+}
+
+// NearestDeckCards returns up to k cards in the deck whose stored embeddings are
+// most similar to the given vector, best match first
+func (s *DatabaseService) NearestDeckCards(ctx context.Context, deckID, model string, vector []float32, k int) ([]models.CardSimilarity, error) {
+	if s.vectorEnabled {
+		var rows []struct {
+			FlashcardID string  `gorm:"column:flashcardId"`
+			Similarity  float64 `gorm:"column:similarity"`
+		}
+		err := s.db.WithContext(ctx).Raw(`SELECT e."flashcardId", 1 - (e."embedding"::vector <=> @query::vector) AS similarity
+			FROM "CardEmbedding" e
+			JOIN "Flashcard" f ON f."id" = e."flashcardId"
+			WHERE f."deckId" = @deck AND e."model" = @model
+			ORDER BY e."embedding"::vector <=> @query::vector
+			LIMIT @k`,
+			map[string]interface{}{"query": models.Vector(vector), "deck": deckID, "model": model, "k": k},
+		).Scan(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+
+		result := make([]models.CardSimilarity, 0, len(rows))
+		for _, row := range rows {
+			result = append(result, models.CardSimilarity{FlashcardID: row.FlashcardID, Similarity: row.Similarity})
+		}
+		return result, nil
+	}
+
+	// Without pgvector, load the deck's vectors and compare them in process
+	var embeddings []models.CardEmbedding
+	err := s.db.WithContext(ctx).Joins("JOIN \"Flashcard\" f ON f.\"id\" = \"CardEmbedding\".\"flashcardId\"").
+		Where("f.\"deckId\" = ? AND \"CardEmbedding\".\"model\" = ?", deckID, model).
+		Find(&embeddings).Error
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]models.CardSimilarity, 0, len(embeddings))
+	for _, embedding := range embeddings {
+		result = append(result, models.CardSimilarity{
+			FlashcardID: embedding.FlashcardID,
+			Similarity:  CalculateSimilarity(vector, embedding.Embedding),
+		})
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Similarity > result[j].Similarity
+	})
+	if len(result) > k {
+		result = result[:k]
+	}
+	return result, nil
+}
+
+// SessionOptions change how a session's cards are selected. Unset fields
+// keep the value stored on the session.
+type SessionOptions struct {
+	DueOnly  *bool
+	TimeZone *string
+}
+
+func (o SessionOptions) updates() map[string]interface{} {
+	updates := make(map[string]interface{})
+	if o.DueOnly != nil {
+		updates["dueOnly"] = *o.DueOnly
+	}
+	if o.TimeZone != nil {
+		updates["timeZone"] = *o.TimeZone
+	}
+	return updates
+}
+
+// QueueLimits cap the jobs waiting for a worker. Zero means no limit.
+type QueueLimits struct {
+	MaxQueued        int
+	MaxQueuedPerUser int
+}
+
+// EnqueueJob adds a job for the session that can be claimed immediately and
+// saves options on the session in the same transaction. If the session
+// already has a queued or running job, or the user already used the
+// idempotency key, that job is returned instead, created is false and
+// options are ignored, so a duplicate request cannot change a job in flight.
+// It returns ErrUserQueueFull or ErrQueueFull when a limit is reached; the
+// limits are checked under locks held until the job is inserted, so
+// concurrent submits cannot all slip past them. It returns
+// ErrSessionCancelled for a cancelled session.
+func (s *DatabaseService) EnqueueJob(ctx context.Context, session *models.StudySession, priority int, idempotencyKey string, options SessionOptions, limits QueueLimits) (job *models.StudySessionJob, created bool, err error) {
+	job = newJob(session, priority)
+	if idempotencyKey != "" {
+		job.RequestKey = &idempotencyKey
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Holds off CancelStudySession until the job is in place for it to cancel
+		var current models.StudySession
+		if err := tx.Clauses(clause.Locking{Strength: "SHARE"}).Select("status").First(&current, "id = ?", session.ID).Error; err != nil {
+			return err
+		}
+		if current.Status == models.SessionStatusCancelled {
+			return ErrSessionCancelled
+		}
+
+		if limits.MaxQueuedPerUser > 0 {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "queue:"+session.UserID).Error; err != nil {
+				return err
+			}
+			queued, err := countQueuedJobs(tx, session.UserID)
+			if err != nil {
+				return fmt.Errorf("failed to check user queue size: %w", err)
+			}
+			if queued >= int64(limits.MaxQueuedPerUser) {
+				return ErrUserQueueFull
+			}
+		}
+		// Taken after the user's lock, always in this order
+		if limits.MaxQueued > 0 {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "queue").Error; err != nil {
+				return err
+			}
+			queued, err := countQueuedJobs(tx, "")
+			if err != nil {
+				return fmt.Errorf("failed to check queue size: %w", err)
+			}
+			if queued >= int64(limits.MaxQueued) {
+				return ErrQueueFull
+			}
+		}
+
+		// Unique indexes on active jobs per session and on idempotency keys
+		// per user turn a racing duplicate into a no-op
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(job)
+		if result.Error != nil {
+			return result.Error
+		}
+		created = result.RowsAffected == 1
+		if !created {
+			return nil
+		}
+
+		if updates := options.updates(); len(updates) > 0 {
+			return tx.Model(&models.StudySession{}).Where("id = ?", session.ID).Updates(updates).Error
+		}
+		return nil
+	})
+	if errors.Is(err, ErrUserQueueFull) || errors.Is(err, ErrQueueFull) {
+		// A duplicate of a request that got in first is not rejected
+		if existing, findErr := s.FindExistingJob(ctx, session, idempotencyKey); findErr == nil && existing != nil {
+			return existing, false, nil
+		}
+		return nil, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if created {
+		return job, true, nil
+	}
+
+	existing, err := s.FindExistingJob(ctx, session, idempotencyKey)
+	if err != nil {
+		return nil, false, err
+	}
+	if existing == nil {
+		// The conflicting job finished in the meantime
+		return nil, false, fmt.Errorf("conflicting job for session %s no longer active", session.ID)
+	}
+	return existing, false, nil
+}
+
+// FindExistingJob returns the job created with the user's idempotency key,
+// or otherwise the session's queued or running job. Returns nil if there is
+// neither, and ErrIdempotencyKeyReused if the key belongs to another session.
+func (s *DatabaseService) FindExistingJob(ctx context.Context, session *models.StudySession, idempotencyKey string) (*models.StudySessionJob, error) {
+	var jobs []models.StudySessionJob
+
+	if idempotencyKey != "" {
+		err := s.db.WithContext(ctx).
+			Where("\"userId\" = ? AND \"idempotencyKey\" = ?", session.UserID, idempotencyKey).
+			Limit(1).Find(&jobs).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(jobs) > 0 {
+			if jobs[0].SessionID != session.ID {
+				return nil, ErrIdempotencyKeyReused
+			}
+			return &jobs[0], nil
+		}
+	}
+
+	err := s.db.WithContext(ctx).
+		Where("\"sessionId\" = ? AND status IN ?", session.ID, []string{models.JobStatusQueued, models.JobStatusRunning}).
+		Limit(1).Find(&jobs).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) > 0 {
+		return &jobs[0], nil
+	}
+	return nil, nil
+}
+
+func newJob(session *models.StudySession, priority int) *models.StudySessionJob {
+	return &models.StudySessionJob{
+		ID:        generateUUID(),
+		SessionID: session.ID,
+		UserID:    session.UserID,
+		Priority:  priority,
+		Status:    models.JobStatusQueued,
+		RunAt:     time.Now(),
+	}
+}
+
+// countQueuedJobs returns the number of jobs waiting for a worker, or the
+// number one user has waiting when userID is set
+func countQueuedJobs(tx *gorm.DB, userID string) (int64, error) {
+	query := tx.Model(&models.StudySessionJob{}).Where("status = ?", models.JobStatusQueued)
+	if userID != "" {
+		query = query.Where("\"userId\" = ?", userID)
+	}
+	var count int64
+	err := query.Count(&count).Error
+	return count, err
+}
+
+// ClaimJob locks the next runnable job for a worker until the visibility
+// timeout expires. Jobs whose lock expired while running are claimed again.
+// Concurrent claims from other replicas skip rows that are already locked.
+// Returns nil when there is nothing to do.
+//
+// Interactive jobs go before batch jobs. Within a priority the user with the
+// fewest running jobs goes first, so users take turns rather than being
+// served in arrival order, and users already running maxRunningPerUser jobs
+// are skipped. Claims racing on other replicas can briefly exceed that limit.
+//
+// The candidates come from the statement's snapshot, so the locking
+// subquery checks again that the job is claimable: a job another replica
+// claimed and committed in the meantime is re-read when locked and must not
+// match a second time.
+func (s *DatabaseService) ClaimJob(ctx context.Context, workerID string, visibility time.Duration, maxRunningPerUser int) (*models.StudySessionJob, error) {
+	var jobs []models.StudySessionJob
+	err := s.db.WithContext(ctx).Raw(`WITH running AS (
+			SELECT "userId", COUNT(*) AS jobs FROM "StudySessionJob"
+			WHERE "status" = @running AND "lockedUntil" >= NOW()
+			GROUP BY "userId"
+		), candidates AS (
+			SELECT j."id", j."priority", j."runAt", COALESCE(r.jobs, 0) AS running,
+				ROW_NUMBER() OVER (PARTITION BY j."userId", j."priority" ORDER BY j."runAt") AS turn
+			FROM "StudySessionJob" j
+			LEFT JOIN running r ON r."userId" = j."userId"
+			WHERE ((j."status" = @queued AND j."runAt" <= NOW())
+				OR (j."status" = @running AND j."lockedUntil" < NOW()))
+				AND (@limit <= 0 OR COALESCE(r.jobs, 0) < @limit)
+		)
+		UPDATE "StudySessionJob"
+		SET "status" = @running, "lockedBy" = @worker, "lockedUntil" = NOW() + make_interval(secs => @secs),
+			"attempts" = "attempts" + 1, "updatedAt" = NOW()
+		WHERE "id" = (
+			SELECT j."id" FROM "StudySessionJob" j
+			JOIN candidates c ON c."id" = j."id"
+			WHERE (j."status" = @queued AND j."runAt" <= NOW())
+				OR (j."status" = @running AND j."lockedUntil" < NOW())
+			ORDER BY c."priority", c.running, c.turn, c."runAt"
+			FOR UPDATE OF j SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING *`,
+		map[string]interface{}{
+			"running": models.JobStatusRunning,
+			"queued":  models.JobStatusQueued,
+			"worker":  workerID,
+			"secs":    visibility.Seconds(),
+			"limit":   maxRunningPerUser,
+		},
+	).Scan(&jobs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+	return &jobs[0], nil
+}
+
+// HeartbeatJob extends a worker's lock on a running job. It returns
+// ErrJobLockLost if another worker has taken the job over. The lock expiry
+// uses the database clock, as ClaimJob compares against it, so clock skew
+// between replicas cannot expire a live job.
+func (s *DatabaseService) HeartbeatJob(ctx context.Context, jobID, workerID string, visibility time.Duration) error {
+	result := s.db.WithContext(ctx).Model(&models.StudySessionJob{}).
+		Where("id = ? AND \"lockedBy\" = ? AND status = ?", jobID, workerID, models.JobStatusRunning).
+		Updates(map[string]interface{}{
+			"lockedUntil": gorm.Expr("NOW() + make_interval(secs => ?)", visibility.Seconds()),
+			"updatedAt":   time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrJobLockLost
+	}
+	return nil
+}
+
+// FinishJob records the outcome of a job still held by the worker
+func (s *DatabaseService) FinishJob(ctx context.Context, jobID, workerID, status string, jobErr error) error {
+	updates := map[string]interface{}{
+		"status":      status,
+		"lockedBy":    nil,
+		"lockedUntil": nil,
+		"updatedAt":   time.Now(),
+	}
+	if jobErr != nil {
+		updates["lastError"] = jobErr.Error()
+	}
+
+	result := s.db.WithContext(ctx).Model(&models.StudySessionJob{}).
+		Where("id = ? AND \"lockedBy\" = ?", jobID, workerID).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrJobLockLost
+	}
+	return nil
+}
+
+// RequeueOrphanedSessions enqueues sessions left in PROCESSING without a
+// pending or running job, which happens when a worker dies mid-session
+func (s *DatabaseService) RequeueOrphanedSessions(ctx context.Context) ([]string, error) {
+	var sessions []models.StudySession
+	err := s.db.WithContext(ctx).
+		Where(`status = ? AND NOT EXISTS (
+			SELECT 1 FROM "StudySessionJob" j
+			WHERE j."sessionId" = "StudySession"."id" AND j."status" IN ?
+		)`, models.SessionStatusProcessing, []string{models.JobStatusQueued, models.JobStatusRunning}).
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	sessionIDs := make([]string, 0, len(sessions))
+	for i := range sessions {
+		if _, _, err := s.EnqueueJob(ctx, &sessions[i], models.JobPriorityInteractive, "", SessionOptions{}, QueueLimits{}); err != nil {
+			return nil, err
+		}
+		sessionIDs = append(sessionIDs, sessions[i].ID)
+	}
+	return sessionIDs, nil
+}
+
+// RetryJob releases a failed job back to the queue to run again at runAt
+func (s *DatabaseService) RetryJob(ctx context.Context, jobID, workerID string, runAt time.Time, jobErr error) error {
+	result := s.db.WithContext(ctx).Model(&models.StudySessionJob{}).
+		Where("id = ? AND \"lockedBy\" = ?", jobID, workerID).
+		Updates(map[string]interface{}{
+			"status":      models.JobStatusQueued,
+			"runAt":       runAt,
+			"lockedBy":    nil,
+			"lockedUntil": nil,
+			"lastError":   jobErr.Error(),
+			"updatedAt":   time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrJobLockLost
+	}
+	return nil
+}
+
+// ReleaseJob returns an interrupted job to the queue to run again
+// immediately. The attempt it was claimed with is not counted.
+func (s *DatabaseService) ReleaseJob(ctx context.Context, jobID, workerID string) error {
+	result := s.db.WithContext(ctx).Model(&models.StudySessionJob{}).
+		Where("id = ? AND \"lockedBy\" = ?", jobID, workerID).
+		Updates(map[string]interface{}{
+			"status":      models.JobStatusQueued,
+			"runAt":       time.Now(),
+			"attempts":    gorm.Expr("GREATEST(\"attempts\" - 1, 0)"),
+			"lockedBy":    nil,
+			"lockedUntil": nil,
+			"updatedAt":   time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrJobLockLost
+	}
+	return nil
+}
+
+// DeadLetterJob marks a job and its session as failed and records the job in
+// the dead-letter store
+func (s *DatabaseService) DeadLetterJob(ctx context.Context, job *models.StudySessionJob, workerID, reason string, jobErr error) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.StudySessionJob{}).
+			Where("id = ? AND \"lockedBy\" = ?", job.ID, workerID).
+			Updates(map[string]interface{}{
+				"status":      models.JobStatusFailed,
+				"lockedBy":    nil,
+				"lockedUntil": nil,
+				"lastError":   jobErr.Error(),
+				"updatedAt":   time.Now(),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrJobLockLost
+		}
+
+		deadLetter := models.StudySessionDeadLetter{
+			ID:        generateUUID(),
+			JobID:     job.ID,
+			SessionID: job.SessionID,
+			Reason:    reason,
+			Attempts:  job.Attempts,
+			LastError: jobErr.Error(),
+			FailedAt:  time.Now(),
+		}
+		if err := tx.Create(&deadLetter).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&models.StudySession{}).Where("id = ?", job.SessionID).Update("status", models.SessionStatusFailed).Error
+	})
+}
+
+// ListDeadLetters returns dead-lettered jobs, newest first. Requeued entries
+// are only included when includeRequeued is set.
+func (s *DatabaseService) ListDeadLetters(ctx context.Context, limit, offset int, includeRequeued bool) ([]models.StudySessionDeadLetter, int64, error) {
+	query := s.db.WithContext(ctx).Model(&models.StudySessionDeadLetter{})
+	if !includeRequeued {
+		query = query.Where("\"requeuedAt\" IS NULL")
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var deadLetters []models.StudySessionDeadLetter
+	err := query.Order("\"failedAt\" DESC").Limit(limit).Offset(offset).Find(&deadLetters).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return deadLetters, total, nil
+}
+
+func (s *DatabaseService) GetDeadLetter(ctx context.Context, id string) (*models.StudySessionDeadLetter, error) {
+	var deadLetter models.StudySessionDeadLetter
+	if err := s.db.WithContext(ctx).First(&deadLetter, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &deadLetter, nil
+}
+
+// RequeueDeadLetter enqueues a fresh job for a dead-lettered session and
+// resets the session to PENDING. It returns ErrAlreadyQueued, leaving the
+// dead letter as it is, if the session has a queued or running job.
+func (s *DatabaseService) RequeueDeadLetter(ctx context.Context, id string) (*models.StudySessionJob, error) {
+	var job *models.StudySessionJob
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var deadLetter models.StudySessionDeadLetter
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&deadLetter, "id = ?", id).Error; err != nil {
+			return err
+		}
+		if deadLetter.RequeuedAt != nil {
+			return ErrAlreadyRequeued
+		}
+
+		var session models.StudySession
+		if err := tx.First(&session, "id = ?", deadLetter.SessionID).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		// The unique index on active jobs per session turns a second job for
+		// the session into a no-op
+		job = newJob(&session, models.JobPriorityInteractive)
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(job)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrAlreadyQueued
+		}
+
+		if err := tx.Model(&deadLetter).Update("requeuedAt", now).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&session).Update("status", models.SessionStatusPending).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *DatabaseService) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	return s.db.WithContext(ctx).Create(key).Error
+}
+
+// ListAPIKeys returns a user's keys, newest first, including revoked ones
+func (s *DatabaseService) ListAPIKeys(ctx context.Context, userID string) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	err := s.db.WithContext(ctx).
+		Where("\"userId\" = ?", userID).
+		Order("\"createdAt\" DESC").
+		Find(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *DatabaseService) GetAPIKeyByPrefix(ctx context.Context, prefix string) (*models.APIKey, error) {
+	var key models.APIKey
+	if err := s.db.WithContext(ctx).First(&key, "prefix = ?", prefix).Error; err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// RevokeAPIKey revokes one of the user's keys. Keys of other users are
+// reported as missing.
+func (s *DatabaseService) RevokeAPIKey(ctx context.Context, id, userID string) (*models.APIKey, error) {
+	var key models.APIKey
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&key, "id = ? AND \"userId\" = ?", id, userID).Error
+		if err != nil {
+			return err
+		}
+		if key.RevokedAt != nil {
+			return nil
+		}
+
+		now := time.Now()
+		key.RevokedAt = &now
+		return tx.Model(&key).Update("revokedAt", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// TouchAPIKey records that a key was used. Writes are skipped when the last
+// recorded use is less than a minute old, so busy scripts do not write on
+// every request.
+func (s *DatabaseService) TouchAPIKey(ctx context.Context, id string) error {
+	return s.db.WithContext(ctx).Model(&models.APIKey{}).
+		Where("id = ? AND (\"lastUsedAt\" IS NULL OR \"lastUsedAt\" < NOW() - INTERVAL '1 minute')", id).
+		Update("lastUsedAt", gorm.Expr("NOW()")).Error
+}
+
+// RecordReview applies a review to the user's metadata for a card, creating
+// the row on the card's first review, and writes the review to the log.
+// entry describes the review; its intervals and FirstReview are filled in
+// here. review receives the current metadata, with Repetitions -1 for a new
+// row, and updates it in place. When the review comes from a session, the
+// session must belong to the user and contain the card.
+func (s *DatabaseService) RecordReview(ctx context.Context, entry *models.ReviewLog, review func(*models.SRSCardMetadata)) (*models.SRSCardMetadata, error) {
+	var metadata models.SRSCardMetadata
+	userID, flashcardID, sessionID := entry.UserID, entry.FlashcardID, entry.SessionID
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("id").First(&models.Flashcard{}, "id = ?", flashcardID).Error; err != nil {
+			return err
+		}
+
+		if sessionID != nil {
+			var session models.StudySession
+			err := tx.Select("id", "userId").First(&session, "id = ?", *sessionID).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && session.UserID != userID) {
+				return ErrSessionNotFound
+			}
+			if err != nil {
+				return err
+			}
+
+			var count int64
+			err = tx.Model(&models.StudySessionCard{}).
+				Where("\"studySessionId\" = ? AND \"flashcardId\" = ?", *sessionID, flashcardID).
+				Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				return ErrCardNotInSession
+			}
+		}
+
+		// Serialize reviews of the same card by the same user, including the
+		// first one, which has no row to lock yet
+		if err := lockCardReviews(tx, userID, flashcardID); err != nil {
+			return err
+		}
+
+		err := tx.Where("\"userId\" = ? AND \"flashcardId\" = ?", userID, flashcardID).First(&metadata).Error
+		isNew := errors.Is(err, gorm.ErrRecordNotFound)
+		if err != nil && !isNew {
+			return err
+		}
+		if isNew {
+			metadata = models.SRSCardMetadata{
+				ID:          generateUUID(),
+				UserID:      userID,
+				FlashcardID: flashcardID,
+				Repetitions: -1,
+			}
+		}
+
+		// The first review introduces the card, counting against the user's
+		// daily limit of new cards
+		entry.FirstReview = metadata.Repetitions < 0 || metadata.LastReviewed == nil
+		if entry.FirstReview {
+			if metadata.IntroducedAt == nil {
+				metadata.IntroducedAt = &entry.ReviewedAt
+			}
+		} else {
+			entry.PreviousInterval = metadata.Interval
+		}
+
+		review(&metadata)
+		if sessionID != nil {
+			metadata.LastSessionID = sessionID
+		}
+		entry.NextInterval = metadata.Interval
+
+		if entry.ID == "" {
+			entry.ID = generateUUID()
+		}
+		if err := tx.Create(entry).Error; err != nil {
+			return err
+		}
+		return saveSRSMetadata(tx, &metadata, isNew)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// lockCardReviews takes a transaction-scoped lock on one user's reviews of
+// one card
+func lockCardReviews(tx *gorm.DB, userID, flashcardID string) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "srs:"+userID+":"+flashcardID).Error
+}
+
+// saveSRSMetadata writes every column, so zero values are stored rather
+// than replaced by column defaults
+func saveSRSMetadata(tx *gorm.DB, metadata *models.SRSCardMetadata, isNew bool) error {
+	if isNew {
+		return tx.Select("*").Omit(clause.Associations).Create(metadata).Error
+	}
+	return tx.Select("*").Omit(clause.Associations).Save(metadata).Error
+}
+
+// EachReviewLog calls fn for every logged review, or every review of one
+// user when userID is set, ordered by user, card and time
+func (s *DatabaseService) EachReviewLog(ctx context.Context, userID string, fn func(*models.ReviewLog) error) error {
+	query := s.db.WithContext(ctx).Model(&models.ReviewLog{})
+	if userID != "" {
+		query = query.Where("\"userId\" = ?", userID)
+	}
+
+	rows, err := query.Order("\"userId\", \"flashcardId\", \"reviewedAt\", id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry models.ReviewLog
+		if err := s.db.ScanRows(rows, &entry); err != nil {
+			return err
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ReplaceSRSMetadata overwrites the user's metadata for a card with state
+// rebuilt from the review log up to lastReviewedAt. It returns
+// ErrReplayStale without writing if the card was reviewed after that, so a
+// replay never overwrites a review it did not see.
+func (s *DatabaseService) ReplaceSRSMetadata(ctx context.Context, metadata *models.SRSCardMetadata, lastReviewedAt time.Time) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := lockCardReviews(tx, metadata.UserID, metadata.FlashcardID); err != nil {
+			return err
+		}
+
+		var newer int64
+		err := tx.Model(&models.ReviewLog{}).
+			Where("\"userId\" = ? AND \"flashcardId\" = ? AND \"reviewedAt\" > ?", metadata.UserID, metadata.FlashcardID, lastReviewedAt).
+			Count(&newer).Error
+		if err != nil {
+			return err
+		}
+		if newer > 0 {
+			return ErrReplayStale
+		}
+
+		var existing models.SRSCardMetadata
+		err = tx.Select("id").Where("\"userId\" = ? AND \"flashcardId\" = ?", metadata.UserID, metadata.FlashcardID).First(&existing).Error
+		isNew := errors.Is(err, gorm.ErrRecordNotFound)
+		if err != nil && !isNew {
+			return err
+		}
+		if isNew {
+			metadata.ID = generateUUID()
+		} else {
+			metadata.ID = existing.ID
+		}
+		return saveSRSMetadata(tx, metadata, isNew)
+	})
+}
+
+// GetUserPreference returns the user's preferences, or the defaults if they
+// never saved any
+func (s *DatabaseService) GetUserPreference(ctx context.Context, userID string) (*models.UserPreference, error) {
+	var preference models.UserPreference
+	err := s.db.WithContext(ctx).First(&preference, "\"userId\" = ?", userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &models.UserPreference{
+			UserID:         userID,
+			Scheduler:      scheduler.Default,
+			NewCardsPerDay: models.DefaultNewCardsPerDay,
+			ReviewsPerDay:  models.DefaultReviewsPerDay,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &preference, nil
+}
+
+func (s *DatabaseService) SaveUserPreference(ctx context.Context, preference *models.UserPreference) error {
+	preference.UpdatedAt = time.Now()
+	// Select all columns so a limit of 0 is not replaced by the column default
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "userId"}},
+		UpdateAll: true,
+	}).Select("*").Create(preference).Error
+}
+
+// SetUserScheduler switches the user to a scheduler, keeping their other
+// preferences
+func (s *DatabaseService) SetUserScheduler(ctx context.Context, userID, name string) error {
+	preference := &models.UserPreference{
+		UserID:         userID,
+		Scheduler:      name,
+		NewCardsPerDay: models.DefaultNewCardsPerDay,
+		ReviewsPerDay:  models.DefaultReviewsPerDay,
+		UpdatedAt:      time.Now(),
+	}
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "userId"}},
+		DoUpdates: clause.AssignmentColumns([]string{"scheduler", "updatedAt"}),
+	}).Select("*").Create(preference).Error
+}
+
+// A card counts as reviewed once it has a review on record; rows created by
+// the frontend with negative repetitions are still new
+const reviewedCardCondition = `m."lastReviewed" IS NOT NULL AND m."repetitions" >= 0`
+
+// GetDueQueue returns the user's due queue for one deck, or across their
+// decks when deckID is empty. Reviews are due by dayEnd, ordered by how
+// overdue they are relative to their interval. Without a deck, new cards
+// come from decks the user has studied or reviewed before. Daily limits
+// come from the user's preferences.
+func (s *DatabaseService) GetDueQueue(ctx context.Context, userID, deckID string, dayStart, dayEnd time.Time) (*models.DueQueue, error) {
+	db := s.db.WithContext(ctx)
+
+	if deckID != "" {
+		if err := db.Select("id").First(&models.FlashcardDeck{}, "id = ?", deckID).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	preference, err := s.GetUserPreference(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	queue := &models.DueQueue{}
+
+	// Cards reviewed or introduced today use up the daily limits
+	err = db.Table(`"SRSCardMetadata" m`).
+		Where(`m."userId" = ? AND m."introducedAt" >= ?`, userID, dayStart).
+		Count(&queue.IntroducedToday).Error
+	if err != nil {
+		return nil, err
+	}
+	err = db.Table(`"SRSCardMetadata" m`).
+		Where(`m."userId" = ? AND m."lastReviewed" >= ? AND (m."introducedAt" IS NULL OR m."introducedAt" < ?)`, userID, dayStart, dayStart).
+		Count(&queue.ReviewedToday).Error
+	if err != nil {
+		return nil, err
+	}
+	queue.ReviewLimit = max(preference.ReviewsPerDay-int(queue.ReviewedToday), 0)
+	queue.NewLimit = max(preference.NewCardsPerDay-int(queue.IntroducedToday), 0)
+
+	dueReviews := func() *gorm.DB {
+		query := db.Table(`"SRSCardMetadata" m`).
+			Joins(`JOIN "Flashcard" f ON f.id = m."flashcardId"`).
+			Where(`m."userId" = ? AND `+reviewedCardCondition+` AND m."nextReview" <= ?`, userID, dayEnd)
+		if deckID != "" {
+			query = query.Where(`f."deckId" = ?`, deckID)
+		}
+		return query
+	}
+	if err := dueReviews().Count(&queue.ReviewsDue).Error; err != nil {
+		return nil, err
+	}
+	if queue.ReviewLimit > 0 && queue.ReviewsDue > 0 {
+		var metadata []models.SRSCardMetadata
+		err := dueReviews().Select("m.*").
+			Order(gorm.Expr(`EXTRACT(EPOCH FROM (? - m."nextReview")) / GREATEST(m."interval", 1) DESC, m."nextReview"`, dayStart)).
+			Limit(queue.ReviewLimit).
+			Preload("Flashcard").
+			Find(&metadata).Error
+		if err != nil {
+			return nil, err
+		}
+		for i := range metadata {
+			queue.Reviews = append(queue.Reviews, models.CardWithMetadata{
+				Card:     metadata[i].Flashcard,
+				Metadata: &metadata[i],
+			})
+		}
+	}
+
+	newCards := func() *gorm.DB {
+		query := db.Table(`"Flashcard" f`).
+			Where(`NOT EXISTS (SELECT 1 FROM "SRSCardMetadata" m
+				WHERE m."flashcardId" = f.id AND m."userId" = ? AND `+reviewedCardCondition+`)`, userID)
+		if deckID != "" {
+			return query.Where(`f."deckId" = ?`, deckID)
+		}
+		return query.Where(`f."deckId" IN (
+			SELECT "deckId" FROM "StudySession" WHERE "userId" = ?
+			UNION
+			SELECT f2."deckId" FROM "SRSCardMetadata" m2 JOIN "Flashcard" f2 ON f2.id = m2."flashcardId" WHERE m2."userId" = ?)`, userID, userID)
+	}
+	if err := newCards().Count(&queue.NewAvailable).Error; err != nil {
+		return nil, err
+	}
+	if queue.NewLimit > 0 && queue.NewAvailable > 0 {
+		var cards []models.Flashcard
+		err := newCards().Select("f.*").
+			Order(`f."deckId", f.id`).
+			Limit(queue.NewLimit).
+			Find(&cards).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, card := range cards {
+			queue.New = append(queue.New, models.CardWithMetadata{Card: card})
+		}
+	}
+
+	return queue, nil
 }
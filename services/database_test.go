@@ -0,0 +1,118 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"memoriva-backend/models"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDatabase connects to the Postgres database in TEST_DATABASE_URL and
+// skips the test when it is not set. The database is written to, so it must
+// not be a real one.
+func testDatabase(t *testing.T) *DatabaseService {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := InitDatabase(url)
+	if err != nil {
+		t.Fatalf("Failed to connect to database: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return NewDatabaseService(db)
+}
+
+func TestClaimJobConcurrentClaimers(t *testing.T) {
+	s := testDatabase(t)
+	ctx := context.Background()
+
+	if err := s.db.AutoMigrate(&models.StudySessionJob{}); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	// Other jobs in the table would be claimed too and skew the counts
+	if err := s.db.Exec(`DELETE FROM "StudySessionJob"`).Error; err != nil {
+		t.Fatalf("Failed to clear jobs: %v", err)
+	}
+
+	const jobCount = 50
+	const claimers = 8
+
+	ids := make(map[string]bool, jobCount)
+	for i := 0; i < jobCount; i++ {
+		job := newJob(&models.StudySession{ID: generateUUID(), UserID: fmt.Sprintf("claim-test-user-%d", i)}, models.JobPriorityInteractive)
+		job.RunAt = time.Now().Add(-time.Second)
+		if err := s.db.Create(job).Error; err != nil {
+			t.Fatalf("Failed to create job: %v", err)
+		}
+		ids[job.ID] = true
+	}
+	t.Cleanup(func() {
+		s.db.Exec(`DELETE FROM "StudySessionJob" WHERE "userId" LIKE 'claim-test-user-%'`)
+	})
+
+	var mu sync.Mutex
+	claims := make(map[string][]string)
+	var wg sync.WaitGroup
+	errs := make(chan error, claimers)
+
+	for w := 0; w < claimers; w++ {
+		workerID := fmt.Sprintf("claim-test-worker-%d", w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, err := s.ClaimJob(ctx, workerID, time.Minute, 0)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if job == nil {
+					return
+				}
+				mu.Lock()
+				claims[job.ID] = append(claims[job.ID], workerID)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("ClaimJob failed: %v", err)
+	}
+
+	for id := range ids {
+		if workers := claims[id]; len(workers) != 1 {
+			t.Errorf("job %s claimed %d times, by %v", id, len(workers), workers)
+		}
+	}
+
+	var jobs []models.StudySessionJob
+	if err := s.db.Where(`"userId" LIKE 'claim-test-user-%'`).Find(&jobs).Error; err != nil {
+		t.Fatalf("Failed to load jobs: %v", err)
+	}
+	for _, job := range jobs {
+		if job.Status != models.JobStatusRunning || job.Attempts != 1 {
+			t.Errorf("job %s is %s after %d attempts, want running after 1", job.ID, job.Status, job.Attempts)
+		}
+	}
+
+	// Locked jobs are not claimable until their lock expires
+	job, err := s.ClaimJob(ctx, "claim-test-late-worker", time.Minute, 0)
+	if err != nil {
+		t.Fatalf("ClaimJob failed: %v", err)
+	}
+	if job != nil {
+		t.Errorf("claimed job %s that is still locked", job.ID)
+	}
+}
@@ -2,12 +2,63 @@ package services
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"memoriva-backend/models"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/sashabaranov/go-openai"
 )
 
+const (
+	// Batches stay well under the API limits of 2048 inputs and 300k tokens per request
+	embeddingBatchTokens = 100000
+	embeddingBatchInputs = 512
+	// Inputs longer than the model's 8191 token limit are truncated
+	embeddingMaxInputTokens = 8000
+
+	embeddingConcurrency = 4
+	embeddingMaxRetries  = 4
+	embeddingBaseBackoff = 500 * time.Millisecond
+	embeddingMaxBackoff  = 10 * time.Second
+)
+
+// Embedder turns prompts and cards into vectors for semantic ranking
+type Embedder interface {
+	// Model identifies the vector space; vectors from different models are never compared
+	Model() string
+	GetPromptEmbedding(ctx context.Context, prompt string) ([]float32, error)
+	GetCardEmbeddings(ctx context.Context, cards []models.Flashcard) ([][]float32, map[string]error)
+}
+
+// NewEmbedder returns the embedder for the configured provider. An empty
+// provider uses OpenAI when an API key is set and the local embedder otherwise.
+func NewEmbedder(provider, openAIAPIKey string) (Embedder, error) {
+	switch provider {
+	case "":
+		if openAIAPIKey != "" {
+			return NewEmbeddingService(openAIAPIKey), nil
+		}
+		return NewLocalEmbedder(), nil
+	case "openai":
+		if openAIAPIKey == "" {
+			return nil, fmt.Errorf("openai embedding provider requires OPENAI_API_KEY")
+		}
+		return NewEmbeddingService(openAIAPIKey), nil
+	case "local":
+		return NewLocalEmbedder(), nil
+	default:
+		return nil, fmt.Errorf("unknown embedding provider %q", provider)
+	}
+}
+
+// EmbeddingService embeds text with the OpenAI embeddings API
 type EmbeddingService struct {
 	client *openai.Client
 }
@@ -23,58 +74,141 @@ func NewEmbeddingService(apiKey string) *EmbeddingService {
 	}
 }
 
-func (s *EmbeddingService) GetCardEmbedding(card models.Flashcard) ([]float32, error) {
-	if s.client == nil {
-		return nil, fmt.Errorf("no embedding client available")
+// Model returns the embedding model name stored alongside cached vectors
+func (s *EmbeddingService) Model() string {
+	return string(openai.SmallEmbedding3)
+}
+
+func (s *EmbeddingService) GetCardEmbedding(ctx context.Context, card models.Flashcard) ([]float32, error) {
+	vectors, err := s.createEmbeddings(ctx, []string{cardEmbeddingText(card)})
+	if err != nil {
+		return nil, err
+	}
+	return vectors[0], nil
+}
+
+func (s *EmbeddingService) GetPromptEmbedding(ctx context.Context, prompt string) ([]float32, error) {
+	vectors, err := s.createEmbeddings(ctx, []string{prompt})
+	if err != nil {
+		return nil, err
 	}
+	return vectors[0], nil
+}
 
-	// Combine front and back for embedding
-	text := fmt.Sprintf("%s %s", card.Front, card.Back)
+// GetCardEmbeddings embeds many cards using token-sized batches sent with
+// bounded concurrency. Vectors are returned in input order; cards that could
+// not be embedded have a nil vector and an entry in the error map keyed by
+// card ID.
+func (s *EmbeddingService) GetCardEmbeddings(ctx context.Context, cards []models.Flashcard) ([][]float32, map[string]error) {
+	vectors := make([][]float32, len(cards))
+	cardErrors := make(map[string]error)
+
+	if len(cards) == 0 {
+		return vectors, cardErrors
+	}
 
-	resp, err := s.client.CreateEmbeddings(
-		context.Background(),
-		openai.EmbeddingRequest{
-			Input: []string{text},
-			Model: openai.SmallEmbedding3,
-		},
-	)
+	if s.client == nil {
+		for _, card := range cards {
+			cardErrors[card.ID] = fmt.Errorf("no embedding client available")
+		}
+		return vectors, cardErrors
+	}
 
-	if err != nil {
-		return nil, fmt.Errorf("embedding API error: %w", err)
+	texts := make([]string, len(cards))
+	for i, card := range cards {
+		texts[i] = cardEmbeddingText(card)
 	}
 
-	if len(resp.Data) == 0 {
-		return nil, fmt.Errorf("no embedding data returned")
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, embeddingConcurrency)
+
+	for _, batch := range batchByTokens(texts) {
+		wg.Add(1)
+		semaphore <- struct{}{}
+
+		go func(indices []int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			input := make([]string, len(indices))
+			for i, idx := range indices {
+				input[i] = texts[idx]
+			}
+
+			result, err := s.createEmbeddings(ctx, input)
+
+			mu.Lock()
+			defer mu.Unlock()
+			for i, idx := range indices {
+				if err != nil {
+					cardErrors[cards[idx].ID] = err
+					continue
+				}
+				vectors[idx] = result[i]
+			}
+		}(batch)
 	}
 
-	return resp.Data[0].Embedding, nil
+	wg.Wait()
+	return vectors, cardErrors
 }
 
-func (s *EmbeddingService) GetPromptEmbedding(prompt string) ([]float32, error) {
+// createEmbeddings sends one embedding request, retrying rate limits and
+// server errors with exponential backoff. Vectors are returned in input order.
+func (s *EmbeddingService) createEmbeddings(ctx context.Context, input []string) ([][]float32, error) {
 	if s.client == nil {
 		return nil, fmt.Errorf("no embedding client available")
 	}
 
-	resp, err := s.client.CreateEmbeddings(
-		context.Background(),
-		openai.EmbeddingRequest{
-			Input: []string{prompt},
-			Model: openai.SmallEmbedding3,
-		},
-	)
+	var lastErr error
+	for attempt := 0; attempt <= embeddingMaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(embeddingBackoff(attempt)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
 
-	if err != nil {
-		return nil, fmt.Errorf("embedding API error: %w", err)
-	}
+		resp, err := s.client.CreateEmbeddings(
+			ctx,
+			openai.EmbeddingRequest{
+				Input: input,
+				Model: openai.SmallEmbedding3,
+			},
+		)
+		if err != nil {
+			lastErr = fmt.Errorf("embedding API error: %w", err)
+			if ctx.Err() == nil && isRetryableAPIError(err) {
+				continue
+			}
+			return nil, lastErr
+		}
 
-	if len(resp.Data) == 0 {
-		return nil, fmt.Errorf("no embedding data returned")
+		if len(resp.Data) != len(input) {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", len(input), len(resp.Data))
+		}
+
+		vectors := make([][]float32, len(input))
+		for _, data := range resp.Data {
+			if data.Index < 0 || data.Index >= len(input) {
+				return nil, fmt.Errorf("embedding index %d out of range", data.Index)
+			}
+			vectors[data.Index] = data.Embedding
+		}
+		return vectors, nil
 	}
 
-	return resp.Data[0].Embedding, nil
+	return nil, lastErr
 }
 
 func (s *EmbeddingService) CalculateSimilarity(embedding1, embedding2 []float32) float64 {
+	return CalculateSimilarity(embedding1, embedding2)
+}
+
+// CalculateSimilarity returns the cosine similarity of two vectors
+func CalculateSimilarity(embedding1, embedding2 []float32) float64 {
 	if len(embedding1) != len(embedding2) {
 		return 0.0
 	}
@@ -90,5 +224,65 @@ func (s *EmbeddingService) CalculateSimilarity(embedding1, embedding2 []float32)
 		return 0.0
 	}
 
-	return dotProduct / (norm1 * norm2)
+	return dotProduct / (math.Sqrt(norm1) * math.Sqrt(norm2))
+}
+
+// cardContentHash identifies the card text an embedding was computed from
+func cardContentHash(card models.Flashcard) string {
+	sum := sha256.Sum256([]byte(card.Front + "\x00" + card.Back))
+	return hex.EncodeToString(sum[:])
+}
+
+func cardEmbeddingText(card models.Flashcard) string {
+	// Combine front and back for embedding
+	text := fmt.Sprintf("%s %s", card.Front, card.Back)
+	return truncateToTokens(string(openai.SmallEmbedding3), text, embeddingMaxInputTokens)
+}
+
+// batchByTokens groups input indices so each batch stays within the
+// per-request token and input limits
+func batchByTokens(texts []string) [][]int {
+	var batches [][]int
+	var current []int
+	currentTokens := 0
+
+	for i, text := range texts {
+		tokens := countTokens(string(openai.SmallEmbedding3), text)
+		if len(current) > 0 && (currentTokens+tokens > embeddingBatchTokens || len(current) >= embeddingBatchInputs) {
+			batches = append(batches, current)
+			current = nil
+			currentTokens = 0
+		}
+		current = append(current, i)
+		currentTokens += tokens
+	}
+
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+// isRetryableAPIError reports whether an API call failed with a rate limit or server error
+func isRetryableAPIError(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode == http.StatusTooManyRequests || apiErr.HTTPStatusCode >= 500
+	}
+
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode == http.StatusTooManyRequests || reqErr.HTTPStatusCode >= 500
+	}
+
+	return false
+}
+
+// embeddingBackoff returns an exponential delay with full jitter for the given retry attempt
+func embeddingBackoff(attempt int) time.Duration {
+	backoff := embeddingBaseBackoff << (attempt - 1)
+	if backoff > embeddingMaxBackoff {
+		backoff = embeddingMaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
 }
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrSessionNotFound = fmt.Errorf("session not found")
+	ErrEmptyDeck       = fmt.Errorf("no cards found in deck")
+	ErrNoDueCards      = fmt.Errorf("no due cards in deck")
+)
+
+// Error codes reported by the status API for failed attempts
+const (
+	ErrorCodeSessionNotFound = "session_not_found"
+	ErrorCodeEmptyDeck       = "empty_deck"
+	ErrorCodeNoDueCards      = "no_due_cards"
+	ErrorCodeTimeout         = "timeout"
+	ErrorCodePermanent       = "permanent_error"
+	ErrorCodeTransient       = "transient_error"
+)
+
+// ErrorMessage is what clients are told about a failure with the given
+// code. Raw errors can contain SQL or provider responses, so they are only
+// logged and kept on the job's lastError.
+func ErrorMessage(code string) string {
+	switch code {
+	case ErrorCodeSessionNotFound:
+		return "The study session no longer exists"
+	case ErrorCodeEmptyDeck:
+		return "The deck has no cards"
+	case ErrorCodeNoDueCards:
+		return "No cards in the deck are due"
+	case ErrorCodeTimeout:
+		return "Processing took too long"
+	case ErrorCodePermanent:
+		return "The study session could not be processed"
+	default:
+		return "Processing failed temporarily"
+	}
+}
+
+// PermanentError marks a failure that will not go away on retry, such as a
+// missing session or an empty deck
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err so the queue dead-letters the job instead of retrying it
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err, or any error it wraps, is permanent
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
+// ErrorCode classifies a processing failure for clients
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrSessionNotFound):
+		return ErrorCodeSessionNotFound
+	case errors.Is(err, ErrEmptyDeck):
+		return ErrorCodeEmptyDeck
+	case errors.Is(err, ErrNoDueCards):
+		return ErrorCodeNoDueCards
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorCodeTimeout
+	case IsPermanent(err):
+		return ErrorCodePermanent
+	default:
+		return ErrorCodeTransient
+	}
+}
@@ -0,0 +1,213 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// SessionStage is a step a study session passes through while it is
+// generated
+type SessionStage string
+
+// StageProcessing is reported when a session is running but its current
+// stage is unknown, e.g. because it runs on another replica.
+const (
+	StageQueued       SessionStage = "queued"
+	StageProcessing   SessionStage = "processing"
+	StageLoadingCards SessionStage = "loading_cards"
+	StageEmbedding    SessionStage = "embedding"
+	StageRanking      SessionStage = "ranking"
+	StageLLMSelection SessionStage = "llm_selection"
+	StagePersisting   SessionStage = "persisting"
+	StageReady        SessionStage = "ready"
+	StageFailed       SessionStage = "failed"
+	StageCancelled    SessionStage = "cancelled"
+)
+
+// Terminal reports whether no further events follow this stage
+func (s SessionStage) Terminal() bool {
+	return s == StageReady || s == StageFailed || s == StageCancelled
+}
+
+// SessionEvent reports that a session entered a stage. ElapsedMs counts from
+// the start of the current attempt and PreviousStageMs is how long the stage
+// before this one took. Card counts are filled in once known.
+type SessionEvent struct {
+	SessionID       string       `json:"sessionId"`
+	Stage           SessionStage `json:"stage"`
+	Attempt         int          `json:"attempt,omitempty"`
+	At              time.Time    `json:"at"`
+	ElapsedMs       int64        `json:"elapsedMs"`
+	PreviousStageMs int64        `json:"previousStageMs,omitempty"`
+	TotalCards      int          `json:"totalCards,omitempty"`
+	CandidateCards  int          `json:"candidateCards,omitempty"`
+	SelectedCards   int          `json:"selectedCards,omitempty"`
+	UsedFallback    bool         `json:"usedFallback,omitempty"`
+	RetryAt         *time.Time   `json:"retryAt,omitempty"`
+	Error           string       `json:"error,omitempty"`
+}
+
+// Events buffered per subscriber; a subscriber that falls further behind
+// misses events rather than holding up the worker that publishes them
+const eventSubscriberBuffer = 16
+
+// EventBus fans session progress out to subscribers in this process. It
+// remembers the latest event of each session in progress so late
+// subscribers can start from the current stage. Sessions processed by
+// another replica are not seen here.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan SessionEvent]struct{}
+	latest      map[string]SessionEvent
+	closed      bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[string]map[chan SessionEvent]struct{}),
+		latest:      make(map[string]SessionEvent),
+	}
+}
+
+// Publish sends an event to the session's subscribers without blocking
+func (b *EventBus) Publish(event SessionEvent) {
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	if event.Stage.Terminal() {
+		delete(b.latest, event.SessionID)
+	} else {
+		b.latest[event.SessionID] = event
+	}
+
+	for ch := range b.subscribers[event.SessionID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of the session's events, the latest event
+// published for it if the session is in progress, and a function that ends
+// the subscription. The channel is closed when the bus is closed.
+func (b *EventBus) Subscribe(sessionID string) (<-chan SessionEvent, *SessionEvent, func()) {
+	ch := make(chan SessionEvent, eventSubscriberBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(ch)
+		return ch, nil, func() {}
+	}
+
+	if b.subscribers[sessionID] == nil {
+		b.subscribers[sessionID] = make(map[chan SessionEvent]struct{})
+	}
+	b.subscribers[sessionID][ch] = struct{}{}
+
+	var latest *SessionEvent
+	if event, ok := b.latest[sessionID]; ok {
+		latest = &event
+	}
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[sessionID][ch]; !ok {
+			return
+		}
+		delete(b.subscribers[sessionID], ch)
+		if len(b.subscribers[sessionID]) == 0 {
+			delete(b.subscribers, sessionID)
+		}
+		close(ch)
+	}
+
+	return ch, latest, unsubscribe
+}
+
+// Close ends every subscription, letting open event streams finish during
+// shutdown
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	for sessionID, channels := range b.subscribers {
+		for ch := range channels {
+			close(ch)
+		}
+		delete(b.subscribers, sessionID)
+	}
+}
+
+// sessionProgress publishes the stages of one processing attempt with their
+// timings. Card counts carry over from stage to stage once set.
+type sessionProgress struct {
+	bus          *EventBus
+	sessionID    string
+	attempt      int
+	started      time.Time
+	stageStarted time.Time
+	counts       SessionEvent
+}
+
+func newSessionProgress(bus *EventBus, sessionID string, attempt int) *sessionProgress {
+	now := time.Now()
+	return &sessionProgress{
+		bus:          bus,
+		sessionID:    sessionID,
+		attempt:      attempt,
+		started:      now,
+		stageStarted: now,
+	}
+}
+
+// enter publishes the event for a new stage, filling in identity, timings
+// and the card counts known so far
+func (p *sessionProgress) enter(event SessionEvent) {
+	if p.bus == nil {
+		return
+	}
+
+	if event.TotalCards > 0 {
+		p.counts.TotalCards = event.TotalCards
+	}
+	if event.CandidateCards > 0 {
+		p.counts.CandidateCards = event.CandidateCards
+	}
+	if event.SelectedCards > 0 {
+		p.counts.SelectedCards = event.SelectedCards
+	}
+	p.counts.UsedFallback = p.counts.UsedFallback || event.UsedFallback
+
+	event.TotalCards = p.counts.TotalCards
+	event.CandidateCards = p.counts.CandidateCards
+	event.SelectedCards = p.counts.SelectedCards
+	event.UsedFallback = p.counts.UsedFallback
+
+	now := time.Now()
+	event.SessionID = p.sessionID
+	event.Attempt = p.attempt
+	event.At = now
+	event.ElapsedMs = now.Sub(p.started).Milliseconds()
+	event.PreviousStageMs = now.Sub(p.stageStarted).Milliseconds()
+	p.stageStarted = now
+
+	p.bus.Publish(event)
+}
@@ -0,0 +1,480 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenClaims are the registered claims checked on every token plus the
+// profile claims NextAuth puts in its session token
+type tokenClaims struct {
+	Subject   string   `json:"sub"`
+	Email     string   `json:"email"`
+	Name      string   `json:"name"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+}
+
+// audience accepts both forms of the aud claim: a string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+type joseHeader struct {
+	Algorithm  string `json:"alg"`
+	Encryption string `json:"enc"`
+	KeyID      string `json:"kid"`
+}
+
+// Tolerance for clock differences between the frontend and this server
+const tokenClockSkew = time.Minute
+
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+// decryptNextAuthJWE opens a session token encrypted by NextAuth with "dir"
+// key management. NextAuth v4 uses A256GCM with a key derived from the secret
+// alone; Auth.js v5 uses A256CBC-HS512 with the cookie name as HKDF salt.
+func decryptNextAuthJWE(token, secret, cookieName string) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("malformed JWE")
+	}
+
+	headerJSON, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWE header: %w", err)
+	}
+	var header joseHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("malformed JWE header: %w", err)
+	}
+	if header.Algorithm != "dir" {
+		return nil, fmt.Errorf("unsupported JWE key management %q", header.Algorithm)
+	}
+
+	iv, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWE IV: %w", err)
+	}
+	ciphertext, err := decodeSegment(parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWE ciphertext: %w", err)
+	}
+	tag, err := decodeSegment(parts[4])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWE tag: %w", err)
+	}
+	// The protected header, as sent, is the additional authenticated data
+	aad := []byte(parts[0])
+
+	switch header.Encryption {
+	case "A256GCM":
+		key := hkdfSHA256([]byte(secret), nil, []byte("NextAuth.js Generated Encryption Key"), 32)
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if len(iv) != gcm.NonceSize() {
+			return nil, fmt.Errorf("invalid JWE IV length")
+		}
+		plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), aad)
+		if err != nil {
+			return nil, fmt.Errorf("JWE decryption failed")
+		}
+		return plaintext, nil
+
+	case "A256CBC-HS512":
+		info := fmt.Sprintf("Auth.js Generated Encryption Key (%s)", cookieName)
+		key := hkdfSHA256([]byte(secret), []byte(cookieName), []byte(info), 64)
+		return decryptCBCHS512(key, iv, ciphertext, tag, aad)
+
+	default:
+		return nil, fmt.Errorf("unsupported JWE encryption %q", header.Encryption)
+	}
+}
+
+// decryptCBCHS512 implements AES_256_CBC_HMAC_SHA_512 from RFC 7518 section 5.2
+func decryptCBCHS512(key, iv, ciphertext, tag, aad []byte) ([]byte, error) {
+	macKey, encKey := key[:32], key[32:]
+
+	// MAC over AAD || IV || ciphertext || AAD length in bits
+	aadBits := make([]byte, 8)
+	bits := uint64(len(aad)) * 8
+	for i := 7; i >= 0; i-- {
+		aadBits[i] = byte(bits)
+		bits >>= 8
+	}
+	mac := hmac.New(sha512.New, macKey)
+	mac.Write(aad)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	mac.Write(aadBits)
+	if subtle.ConstantTimeCompare(mac.Sum(nil)[:32], tag) != 1 {
+		return nil, fmt.Errorf("JWE decryption failed")
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("malformed JWE ciphertext")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	// Strip PKCS#7 padding, which the MAC above has already authenticated
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, fmt.Errorf("malformed JWE padding")
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, fmt.Errorf("malformed JWE padding")
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// hkdfSHA256 derives length bytes from secret as in RFC 5869
+func hkdfSHA256(secret, salt, info []byte, length int) []byte {
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var okm, previous []byte
+	for counter := byte(1); len(okm) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(previous)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		previous = expand.Sum(nil)
+		okm = append(okm, previous...)
+	}
+	return okm[:length]
+}
+
+// verifyJWS checks a signed token and returns its payload. HS256 tokens are
+// checked against the shared secret; RS256 and ES256 tokens against the key
+// with the matching ID from the JWKS.
+func verifyJWS(ctx context.Context, token, secret string, jwks *jwksCache) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+
+	headerJSON, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %w", err)
+	}
+	var header joseHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %w", err)
+	}
+
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature: %w", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch header.Algorithm {
+	case "HS256":
+		if secret == "" {
+			return nil, fmt.Errorf("HS256 tokens are not accepted without a shared secret")
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, fmt.Errorf("invalid JWT signature")
+		}
+
+	case "RS256", "ES256":
+		if jwks == nil {
+			return nil, fmt.Errorf("%s tokens are not accepted without a JWKS URL", header.Algorithm)
+		}
+		key, err := jwks.key(ctx, header.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(signed)
+		if err := verifyAsymmetric(header.Algorithm, key, digest[:], signature); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", header.Algorithm)
+	}
+
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %w", err)
+	}
+	return payload, nil
+}
+
+func verifyAsymmetric(algorithm string, key crypto.PublicKey, digest, signature []byte) error {
+	switch algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("JWKS key does not match RS256")
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest, signature); err != nil {
+			return fmt.Errorf("invalid JWT signature")
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return fmt.Errorf("JWKS key does not match ES256")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return fmt.Errorf("invalid JWT signature")
+		}
+	}
+	return nil
+}
+
+// validate checks expiry, not-before, issuer and audience
+func (c *tokenClaims) validate(issuer, aud string, now time.Time) error {
+	if c.ExpiresAt == 0 {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.After(time.Unix(c.ExpiresAt, 0).Add(tokenClockSkew)) {
+		return fmt.Errorf("token expired")
+	}
+	if c.NotBefore != 0 && now.Add(tokenClockSkew).Before(time.Unix(c.NotBefore, 0)) {
+		return fmt.Errorf("token not valid yet")
+	}
+	if issuer != "" && c.Issuer != issuer {
+		return fmt.Errorf("unexpected token issuer %q", c.Issuer)
+	}
+	if aud != "" {
+		found := false
+		for _, candidate := range c.Audience {
+			if candidate == aud {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("token not issued for this audience")
+		}
+	}
+	return nil
+}
+
+// How long fetched signing keys are trusted before the JWKS is fetched again
+const jwksRefreshInterval = time.Hour
+
+// Minimum time between fetches, successful or not, so tokens with unknown
+// key IDs cannot hammer a slow or failing JWKS endpoint
+const jwksRetryInterval = time.Minute
+
+// jwksCache holds the public keys published at a JWKS URL. Unknown key IDs
+// trigger a refetch, at most once a minute, so rotated keys are picked up.
+// Only one fetch runs at a time; other requests wait for it without holding
+// the lock.
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	refreshedAt time.Time
+	attemptedAt time.Time
+	lastErr     error
+	fetching    chan struct{}
+}
+
+func newJWKSCache(url string) *jwksCache {
+	return &jwksCache{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *jwksCache) key(ctx context.Context, keyID string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	if key, ok := c.keys[keyID]; ok && time.Since(c.refreshedAt) < jwksRefreshInterval {
+		c.mu.Unlock()
+		return key, nil
+	}
+
+	done := c.fetching
+	if done == nil {
+		if time.Since(c.attemptedAt) < jwksRetryInterval {
+			defer c.mu.Unlock()
+			return c.lookup(keyID)
+		}
+
+		// This request fetches; the fetch outlives it if it is cancelled, as
+		// other requests may be waiting for the result
+		done = make(chan struct{})
+		c.fetching = done
+		c.attemptedAt = time.Now()
+		c.mu.Unlock()
+
+		keys, err := c.fetch(context.WithoutCancel(ctx))
+
+		c.mu.Lock()
+		if err == nil {
+			c.keys = keys
+			c.refreshedAt = time.Now()
+		}
+		c.lastErr = err
+		c.fetching = nil
+		close(done)
+		defer c.mu.Unlock()
+		return c.lookup(keyID)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookup(keyID)
+}
+
+// lookup returns a cached key. A key fetched earlier is still used when the
+// last refetch failed, so an unreachable JWKS endpoint does not lock out
+// users whose key is known. Must be called with mu held.
+func (c *jwksCache) lookup(keyID string) (crypto.PublicKey, error) {
+	if key, ok := c.keys[keyID]; ok {
+		return key, nil
+	}
+	if c.lastErr != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", c.lastErr)
+	}
+	return nil, fmt.Errorf("unknown signing key %q", keyID)
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func (c *jwksCache) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeSegment(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeSegment(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decodeSegment(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeSegment(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("invalid EC key")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
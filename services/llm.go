@@ -6,228 +6,375 @@ import (
 	"fmt"
 	"log"
 	"memoriva-backend/models"
+	"sort"
 	"strings"
-
-	"github.com/sashabaranov/go-openai"
+	"time"
 )
 
 type LLMService struct {
-	deepSeekClient *openai.Client
-	openAIClient   *openai.Client
+	registry *ProviderRegistry
+	breakers map[string]*CircuitBreaker
+	weakness *WeaknessModel
 }
 
-func NewLLMService(deepSeekAPIKey, openAIAPIKey string) *LLMService {
-	var deepSeekClient *openai.Client
-	var openAIClient *openai.Client
-
-	if deepSeekAPIKey != "" {
-		config := openai.DefaultConfig(deepSeekAPIKey)
-		config.BaseURL = "https://api.deepseek.com/v1"
-		deepSeekClient = openai.NewClientWithConfig(config)
+func NewLLMService(registry *ProviderRegistry, breakerConfig BreakerConfig, weakness *WeaknessModel) *LLMService {
+	breakers := make(map[string]*CircuitBreaker)
+	for _, provider := range registry.All() {
+		breakers[provider.Name()] = NewCircuitBreaker(breakerConfig)
 	}
 
-	if openAIAPIKey != "" {
-		openAIClient = openai.NewClient(openAIAPIKey)
+	return &LLMService{
+		registry: registry,
+		breakers: breakers,
+		weakness: weakness,
 	}
+}
 
-	return &LLMService{
-		deepSeekClient: deepSeekClient,
-		openAIClient:   openAIClient,
+// ProviderStatus describes a chat provider and its circuit breaker
+type ProviderStatus struct {
+	Name    string        `json:"name"`
+	Model   string        `json:"model"`
+	Breaker BreakerStatus `json:"breaker"`
+}
+
+// ProviderStatuses reports the breaker state of every provider for health checks
+func (s *LLMService) ProviderStatuses() []ProviderStatus {
+	var statuses []ProviderStatus
+	for _, provider := range s.registry.All() {
+		statuses = append(statuses, ProviderStatus{
+			Name:    provider.Name(),
+			Model:   provider.Model(),
+			Breaker: s.breakers[provider.Name()].Status(),
+		})
 	}
+	return statuses
 }
 
-func (s *LLMService) AnalyzeCardsForStudy(cards []models.CardWithMetadata, prompt string, maxCards int) ([]string, error) {
-	// Create a prompt for the LLM to analyze and select cards
-	systemPrompt := `You are an intelligent flashcard study assistant. Your task is to analyze flashcard data and select the most appropriate cards for study based on the user's request.
+// AnalyzeCardsForStudy returns the cards to study in order, each with the
+// reason it was picked, and the provider that picked them. Repeated
+// appearances of a card are separate entries marked Repeat.
+func (s *LLMService) AnalyzeCardsForStudy(ctx context.Context, cards []models.CardWithMetadata, prompt string, maxCards int) (*models.CardSelectionResult, error) {
+	// Try each provider routed for card selection in order, skipping any whose circuit is open
+	providers := s.registry.ForTask(TaskCardSelection)
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no LLM client available")
+	}
 
-You will receive:
-1. A collection of flashcards with their front/back content
-2. SRS metadata including review counts (easy, hard, again) and repetition data
-3. A user prompt describing what they want to study
-4. A maximum card limit (but you can select FEWER cards if the user's request is specific)
+	for _, provider := range providers {
+		selections, err := s.selectWithProvider(ctx, provider, cards, prompt, maxCards)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Card selection with %s failed: %v", provider.Name(), err)
+			continue
+		}
 
-Your job is to:
-1. Understand the user's study intent from their prompt
-2. Find cards semantically relevant to the user's prompt (prioritize relevance over quantity)
-3. Analyze card weakness based on SRS data (high again/hard counts = weak cards)
-4. Select the most appropriate cards - if the user asks for specific topics, only select cards related to those topics
-5. If only 2 cards match the user's specific request, return only those 2 cards (don't pad with unrelated cards)
-6. You can repeat very weak cards multiple times in the selection
+		log.Printf("LLM %s selected %d cards", provider.Name(), len(selections))
+		return &models.CardSelectionResult{
+			Selections: selections,
+			Provider:   provider.Name(),
+			Model:      provider.Model(),
+		}, nil
+	}
 
-IMPORTANT: Quality over quantity - better to return 2 highly relevant cards than 20 loosely related ones.
+	log.Printf("All LLM providers failed, using fallback")
+	return &models.CardSelectionResult{
+		Selections:   s.fallbackCardSelection(cards, maxCards),
+		UsedFallback: true,
+	}, nil
+}
 
-Return only a JSON array of flashcard IDs in the order they should be studied.`
+// Map-reduce rounds allowed before the candidate pool is cut to what fits in one prompt
+const maxShortlistRounds = 3
+
+// selectWithProvider asks one provider for a card selection. Cards are
+// pre-ranked; when they do not fit the provider's prompt budget the deck is
+// split into chunks, each chunk is shortlisted in its own request, and the
+// final pick is made among the shortlisted cards.
+func (s *LLMService) selectWithProvider(ctx context.Context, provider ChatProvider, cards []models.CardWithMetadata, prompt string, maxCards int) ([]models.CardSelection, error) {
+	builder := newCardPromptBuilder(provider, s.weakness, time.Now())
+	pool := cards
+
+	for round := 0; ; round++ {
+		chunks := builder.chunk(pool)
+		if len(chunks) == 1 {
+			return s.requestSelection(ctx, provider, builder.userPrompt(prompt, maxCards, chunks[0]), chunks[0], maxCards)
+		}
 
-	// Build the user prompt with card data
-	userPrompt := fmt.Sprintf(`User wants to study: "%s"
-Maximum cards: %d
+		if round >= maxShortlistRounds {
+			log.Printf("Shortlist still spans %d prompts after %d rounds, keeping the top ranked part", len(chunks), round)
+			pool = chunks[0]
+			continue
+		}
 
-Available flashcards:
-`, prompt, maxCards)
+		log.Printf("Deck of %d candidates exceeds the %s prompt budget, shortlisting in %d parts", len(pool), provider.Name(), len(chunks))
 
-	for i, cardData := range cards {
-		if i >= 50 { // Limit to prevent token overflow
-			break
+		shortlisted := make(map[string]bool)
+		for i, chunk := range chunks {
+			selections, err := s.requestSelection(ctx, provider, builder.shortlistPrompt(prompt, maxCards, i+1, len(chunks), chunk), chunk, maxCards)
+			if err != nil {
+				return nil, fmt.Errorf("shortlist part %d: %w", i+1, err)
+			}
+			for _, selection := range selections {
+				shortlisted[selection.CardID] = true
+			}
 		}
 
-		weaknessScore := 0.0
-		if cardData.Metadata != nil {
-			total := cardData.Metadata.EasyReviewCount + cardData.Metadata.HardReviewCount + cardData.Metadata.AgainReviewCount
-			if total > 0 {
-				weaknessScore = float64(cardData.Metadata.AgainReviewCount) + float64(cardData.Metadata.HardReviewCount)*0.5
-				weaknessScore = weaknessScore / float64(total)
+		// Keep the shortlist in ranking order
+		var next []models.CardWithMetadata
+		for _, cardData := range pool {
+			if shortlisted[cardData.Card.ID] {
+				next = append(next, cardData)
 			}
 		}
+		if len(next) == 0 {
+			return nil, fmt.Errorf("no cards shortlisted")
+		}
+		pool = next
+	}
+}
 
-		userPrompt += fmt.Sprintf(`
-ID: %s
-Front: %s
-Back: %s
-Weakness Score: %.2f (0=strong, 1=very weak)
-Reviews: Easy=%d, Hard=%d, Again=%d
-`, cardData.Card.ID, cardData.Card.Front, cardData.Card.Back, weaknessScore,
-			getReviewCount(cardData.Metadata, "easy"),
-			getReviewCount(cardData.Metadata, "hard"),
-			getReviewCount(cardData.Metadata, "again"))
+// requestSelection sends one selection request, giving the model one chance
+// to repair an answer that fails validation. Only API errors count against
+// the provider's circuit breaker; unusable answers just move on to the next
+// provider.
+func (s *LLMService) requestSelection(ctx context.Context, provider ChatProvider, userPrompt string, cards []models.CardWithMetadata, maxCards int) ([]models.CardSelection, error) {
+	breaker := s.breakers[provider.Name()]
+
+	messages := []ChatMessage{
+		{
+			Role:    ChatRoleSystem,
+			Content: cardSelectionSystemPrompt,
+		},
+		{
+			Role:    ChatRoleUser,
+			Content: userPrompt,
+		},
 	}
 
-	userPrompt += "\nReturn a JSON array of selected flashcard IDs:"
+	for attempt := 0; attempt < 2; attempt++ {
+		if !breaker.Allow() {
+			return nil, fmt.Errorf("circuit open")
+		}
+
+		resp, err := provider.Chat(
+			ctx,
+			ChatRequest{
+				Messages:       messages,
+				MaxTokens:      selectionResponseTokens(maxCards),
+				Temperature:    0.3,
+				ResponseSchema: cardSelectionSchema,
+			},
+		)
+		if err != nil && ctx.Err() != nil {
+			// Cancelled by the caller, which says nothing about the provider
+			breaker.Release()
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			breaker.RecordFailure()
+			return nil, fmt.Errorf("LLM API error: %w", err)
+		}
+		breaker.RecordSuccess()
+
+		log.Printf("LLM Response from %s: %s", provider.Name(), resp.Content)
 
-	// Try DeepSeek first, fallback to OpenAI
-	var model string
-	var client *openai.Client
+		choices, problems := parseCardChoices(resp.Content, cards)
+		if len(problems) == 0 || (attempt > 0 && len(choices) > 0) {
+			return buildCardSelections(choices, maxCards), nil
+		}
 
-	if s.deepSeekClient != nil {
-		client = s.deepSeekClient
-		model = "deepseek-chat" // Use DeepSeek model
-	} else if s.openAIClient != nil {
-		client = s.openAIClient
-		model = openai.GPT3Dot5Turbo // Use OpenAI model
-	} else {
-		return nil, fmt.Errorf("no LLM client available")
+		if attempt == 0 {
+			log.Printf("Invalid selection from %s, asking for a repair: %s", provider.Name(), strings.Join(problems, "; "))
+			messages = append(messages,
+				ChatMessage{Role: ChatRoleAssistant, Content: resp.Content},
+				ChatMessage{Role: ChatRoleUser, Content: fmt.Sprintf(
+					"Your response was invalid:\n- %s\n\nReturn only the corrected JSON object, using card IDs from the list above.",
+					strings.Join(problems, "\n- "))},
+			)
+		}
 	}
 
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: model,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleSystem,
-					Content: systemPrompt,
-				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: userPrompt,
-				},
-			},
-			MaxTokens:   1000,
-			Temperature: 0.3,
-		},
-	)
+	return nil, fmt.Errorf("no valid card selection in LLM response")
+}
 
-	if err != nil {
-		log.Printf("LLM API error: %v", err)
-		return s.fallbackCardSelection(cards, maxCards), nil
+// selectionResponseTokens leaves room for a reason on every card, including repeats
+func selectionResponseTokens(maxCards int) int {
+	tokens := 200 + maxCards*2*60
+	if tokens > 4000 {
+		tokens = 4000
 	}
+	return tokens
+}
 
-	if len(resp.Choices) == 0 {
-		log.Printf("No response from LLM")
-		return s.fallbackCardSelection(cards, maxCards), nil
+// cardSelectionSchema is the structured output format for card selection
+var cardSelectionSchema = &ResponseSchema{
+	Name: "card_selection",
+	Schema: json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"cards": {
+				"type": "array",
+				"items": {
+					"type": "object",
+					"properties": {
+						"cardId": {"type": "string"},
+						"reason": {"type": "string"},
+						"repeat": {"type": "boolean"},
+						"priority": {"type": "integer", "enum": [1, 2, 3]}
+					},
+					"required": ["cardId", "reason", "repeat", "priority"],
+					"additionalProperties": false
+				}
+			}
+		},
+		"required": ["cards"],
+		"additionalProperties": false
+	}`),
+}
+
+// cardChoice is one entry of the structured card selection response
+type cardChoice struct {
+	CardID   string `json:"cardId"`
+	Reason   string `json:"reason"`
+	Repeat   bool   `json:"repeat"`
+	Priority int    `json:"priority"`
+}
+
+// parseCardChoices decodes and validates a structured selection response. It
+// returns the usable choices along with a description of every problem found,
+// so a failed response can be sent back to the model for repair.
+func parseCardChoices(response string, availableCards []models.CardWithMetadata) ([]cardChoice, []string) {
+	// Some models wrap JSON in a markdown code fence despite JSON mode
+	content := strings.TrimSpace(response)
+	content = strings.TrimPrefix(content, "```json")
+	content = strings.TrimPrefix(content, "```")
+	content = strings.TrimSuffix(content, "```")
+
+	var parsed struct {
+		Cards []cardChoice `json:"cards"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(content)), &parsed); err != nil {
+		return nil, []string{fmt.Sprintf("response is not a valid JSON object: %v", err)}
 	}
 
-	// Parse the response to extract card IDs
-	responseContent := resp.Choices[0].Message.Content
-	log.Printf("LLM Response: %s", responseContent)
+	if len(parsed.Cards) == 0 {
+		return nil, []string{`"cards" must contain at least one card`}
+	}
 
-	// Try to parse JSON response
-	selectedIDs, err := s.parseCardIDsFromResponse(responseContent)
-	if err != nil {
-		log.Printf("Failed to parse LLM response, using fallback: %v", err)
-		return s.fallbackCardSelection(cards, maxCards), nil
+	// Create a map of available card IDs for fast lookup
+	availableMap := make(map[string]bool)
+	for _, card := range availableCards {
+		availableMap[card.Card.ID] = true
 	}
 
-	// Validate that all selected IDs exist in the available cards
-	validIDs := s.validateCardIDs(selectedIDs, cards)
-	if len(validIDs) == 0 {
-		log.Printf("No valid card IDs found in LLM response, using fallback")
-		return s.fallbackCardSelection(cards, maxCards), nil
+	var choices []cardChoice
+	var problems []string
+	for i, choice := range parsed.Cards {
+		switch {
+		case !availableMap[choice.CardID]:
+			problems = append(problems, fmt.Sprintf("cards[%d]: unknown cardId %q", i, choice.CardID))
+		case strings.TrimSpace(choice.Reason) == "":
+			problems = append(problems, fmt.Sprintf("cards[%d]: reason is required", i))
+		case choice.Priority < 1 || choice.Priority > 3:
+			problems = append(problems, fmt.Sprintf("cards[%d]: priority must be 1, 2 or 3", i))
+		default:
+			choices = append(choices, choice)
+		}
 	}
 
-	log.Printf("LLM selected %d cards: %v", len(validIDs), validIDs)
-	return validIDs, nil
+	return choices, problems
 }
 
-func (s *LLMService) parseCardIDsFromResponse(response string) ([]string, error) {
-	var cardIDs []string
-
-	// Try to find JSON array in the response
-	// Look for patterns like ["id1", "id2", "id3"]
-	startIdx := strings.Index(response, "[")
-	endIdx := strings.LastIndex(response, "]")
+// buildCardSelections turns validated choices into the ordered session. When
+// the model picks too many cards the lowest priority ones are dropped, then
+// cards marked for repetition are appended again while there is room.
+// maxCards comes from the session row, so a non-positive value selects
+// nothing rather than panicking.
+func buildCardSelections(choices []cardChoice, maxCards int) []models.CardSelection {
+	if maxCards <= 0 {
+		return nil
+	}
 
-	if startIdx == -1 || endIdx == -1 || startIdx >= endIdx {
-		return nil, fmt.Errorf("no JSON array found in response")
+	seen := make(map[string]bool)
+	var unique []cardChoice
+	for _, choice := range choices {
+		if !seen[choice.CardID] {
+			seen[choice.CardID] = true
+			unique = append(unique, choice)
+		}
 	}
 
-	jsonStr := response[startIdx : endIdx+1]
+	if len(unique) > maxCards {
+		byPriority := make([]int, len(unique))
+		for i := range byPriority {
+			byPriority[i] = i
+		}
+		sort.SliceStable(byPriority, func(i, j int) bool {
+			return unique[byPriority[i]].Priority < unique[byPriority[j]].Priority
+		})
 
-	// Try to parse as JSON
-	err := json.Unmarshal([]byte(jsonStr), &cardIDs)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse JSON: %w", err)
-	}
+		keep := make(map[int]bool)
+		for _, idx := range byPriority[:min(maxCards, len(byPriority))] {
+			keep[idx] = true
+		}
 
-	return cardIDs, nil
-}
+		var trimmed []cardChoice
+		for i, choice := range unique {
+			if keep[i] {
+				trimmed = append(trimmed, choice)
+			}
+		}
+		unique = trimmed
+	}
 
-func (s *LLMService) validateCardIDs(selectedIDs []string, availableCards []models.CardWithMetadata) []string {
-	// Create a map of available card IDs for fast lookup
-	availableMap := make(map[string]bool)
-	for _, card := range availableCards {
-		availableMap[card.Card.ID] = true
+	selections := make([]models.CardSelection, 0, len(unique))
+	for _, choice := range unique {
+		selections = append(selections, models.CardSelection{
+			CardID:   choice.CardID,
+			Reason:   choice.Reason,
+			Priority: choice.Priority,
+		})
 	}
 
-	// Filter out invalid IDs
-	var validIDs []string
-	for _, id := range selectedIDs {
-		if availableMap[id] {
-			validIDs = append(validIDs, id)
+	for _, choice := range unique {
+		if len(selections) >= maxCards {
+			break
+		}
+		if choice.Repeat {
+			selections = append(selections, models.CardSelection{
+				CardID:   choice.CardID,
+				Reason:   choice.Reason,
+				Priority: choice.Priority,
+				Repeat:   true,
+			})
 		}
 	}
 
-	return validIDs
+	return selections
 }
 
-func (s *LLMService) fallbackCardSelection(cards []models.CardWithMetadata, maxCards int) []string {
+func (s *LLMService) fallbackCardSelection(cards []models.CardWithMetadata, maxCards int) []models.CardSelection {
 	// Improved fallback: prioritize weak cards, but be flexible with count
-	var selectedIDs []string
+	var selections []models.CardSelection
 
 	// If we have very few cards, just return all of them
 	if len(cards) <= 3 {
 		for _, card := range cards {
-			selectedIDs = append(selectedIDs, card.Card.ID)
+			selections = append(selections, models.CardSelection{CardID: card.Card.ID, Reason: "Small deck: every card included", Priority: 2})
 		}
-		return selectedIDs
+		return selections
 	}
 
-	// Sort by weakness score
+	// Split cards by weakness
+	now := time.Now()
 	weakCards := make([]models.CardWithMetadata, 0)
 	normalCards := make([]models.CardWithMetadata, 0)
 
 	for _, card := range cards {
-		if card.Metadata != nil {
-			total := card.Metadata.EasyReviewCount + card.Metadata.HardReviewCount + card.Metadata.AgainReviewCount
-			if total > 0 {
-				weaknessScore := float64(card.Metadata.AgainReviewCount+card.Metadata.HardReviewCount) / float64(total)
-				if weaknessScore > 0.3 { // Consider weak if >30% hard/again
-					weakCards = append(weakCards, card)
-				} else {
-					normalCards = append(normalCards, card)
-				}
-			} else {
-				normalCards = append(normalCards, card)
-			}
+		if s.weakness.IsWeak(card.Metadata, now) {
+			weakCards = append(weakCards, card)
 		} else {
 			normalCards = append(normalCards, card)
 		}
@@ -242,20 +389,14 @@ func (s *LLMService) fallbackCardSelection(cards []models.CardWithMetadata, maxC
 
 	// Select weak cards first
 	for i, card := range weakCards {
-		if len(selectedIDs) >= optimalCount {
+		if len(selections) >= optimalCount {
 			break
 		}
-		selectedIDs = append(selectedIDs, card.Card.ID)
-
-		// Repeat very weak cards
-		if card.Metadata != nil {
-			total := card.Metadata.EasyReviewCount + card.Metadata.HardReviewCount + card.Metadata.AgainReviewCount
-			if total > 0 {
-				weaknessScore := float64(card.Metadata.AgainReviewCount) / float64(total)
-				if weaknessScore > 0.5 && len(selectedIDs) < optimalCount {
-					selectedIDs = append(selectedIDs, card.Card.ID) // Repeat very weak card
-				}
-			}
+		selections = append(selections, models.CardSelection{CardID: card.Card.ID, Reason: "Likely to be forgotten soon", Priority: 1})
+
+		// Repeat cards that are probably forgotten by now
+		if s.weakness.NeedsRepeat(card.Metadata, now) && len(selections) < optimalCount {
+			selections = append(selections, models.CardSelection{CardID: card.Card.ID, Reason: "Likely forgotten by now, repeated for practice", Priority: 1, Repeat: true})
 		}
 
 		if i >= optimalCount/2 { // Don't use more than half slots for weak cards
@@ -265,13 +406,13 @@ func (s *LLMService) fallbackCardSelection(cards []models.CardWithMetadata, maxC
 
 	// Fill remaining slots with normal cards
 	for _, card := range normalCards {
-		if len(selectedIDs) >= optimalCount {
+		if len(selections) >= optimalCount {
 			break
 		}
-		selectedIDs = append(selectedIDs, card.Card.ID)
+		selections = append(selections, models.CardSelection{CardID: card.Card.ID, Reason: "Ranked relevant to your prompt", Priority: 2})
 	}
 
-	return selectedIDs
+	return selections
 }
 
 // Helper function for min
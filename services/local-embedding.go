@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"memoriva-backend/models"
+	"strings"
+	"unicode"
+)
+
+const (
+	localEmbeddingDimensions = 512
+	localEmbeddingModel      = "local-hash-v1-512"
+)
+
+// stopWords carry little meaning and would otherwise dominate short prompts
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"by": true, "for": true, "from": true, "how": true, "i": true, "in": true, "is": true,
+	"it": true, "me": true, "my": true, "of": true, "on": true, "or": true, "study": true,
+	"that": true, "the": true, "this": true, "to": true, "want": true, "what": true,
+	"with": true,
+}
+
+// LocalEmbedder produces deterministic feature-hashing vectors without any
+// network access. Words, word bigrams and character trigrams are hashed into a
+// fixed number of buckets with sublinear term frequency weighting. The vectors
+// only depend on the text itself, so cached card embeddings stay valid as
+// decks change.
+type LocalEmbedder struct{}
+
+func NewLocalEmbedder() *LocalEmbedder {
+	return &LocalEmbedder{}
+}
+
+func (e *LocalEmbedder) Model() string {
+	return localEmbeddingModel
+}
+
+func (e *LocalEmbedder) GetPromptEmbedding(ctx context.Context, prompt string) ([]float32, error) {
+	vector := hashEmbedding(prompt)
+	if vector == nil {
+		return nil, fmt.Errorf("prompt has no embeddable terms")
+	}
+	return vector, nil
+}
+
+func (e *LocalEmbedder) GetCardEmbeddings(ctx context.Context, cards []models.Flashcard) ([][]float32, map[string]error) {
+	vectors := make([][]float32, len(cards))
+	cardErrors := make(map[string]error)
+
+	for i, card := range cards {
+		vector := hashEmbedding(cardEmbeddingText(card))
+		if vector == nil {
+			cardErrors[card.ID] = fmt.Errorf("card has no embeddable terms")
+			continue
+		}
+		vectors[i] = vector
+	}
+
+	return vectors, cardErrors
+}
+
+// hashEmbedding returns an L2-normalised feature-hashing vector, or nil when
+// the text contains no usable terms
+func hashEmbedding(text string) []float32 {
+	counts := make(map[string]int)
+
+	words := tokenize(text)
+	for i, word := range words {
+		counts["w:"+word]++
+		if i > 0 {
+			counts["b:"+words[i-1]+" "+word]++
+		}
+
+		runes := []rune(" " + word + " ")
+		for j := 0; j+3 <= len(runes); j++ {
+			counts["c:"+string(runes[j:j+3])]++
+		}
+	}
+
+	if len(counts) == 0 {
+		return nil
+	}
+
+	weights := make([]float64, localEmbeddingDimensions)
+	for feature, count := range counts {
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		sum := h.Sum64()
+
+		weight := 1 + math.Log(float64(count))
+		// Character trigrams are plentiful, keep them from drowning out whole words
+		if strings.HasPrefix(feature, "c:") {
+			weight *= 0.5
+		}
+		// The sign bit keeps colliding features from always adding up
+		if sum&(1<<63) != 0 {
+			weight = -weight
+		}
+
+		weights[sum%localEmbeddingDimensions] += weight
+	}
+
+	var norm float64
+	for _, w := range weights {
+		norm += w * w
+	}
+	if norm == 0 {
+		return nil
+	}
+	norm = math.Sqrt(norm)
+
+	vector := make([]float32, localEmbeddingDimensions)
+	for i, w := range weights {
+		vector[i] = float32(w / norm)
+	}
+	return vector
+}
+
+// tokenize lowercases text and splits it into words, dropping stop words.
+// Scripts without spaces (such as CJK) are split into single characters.
+func tokenize(text string) []string {
+	var words []string
+	var current []rune
+
+	flush := func() {
+		if len(current) == 0 {
+			return
+		}
+		word := string(current)
+		current = current[:0]
+		if !stopWords[word] {
+			words = append(words, word)
+		}
+	}
+
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flush()
+			words = append(words, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			current = append(current, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	return words
+}
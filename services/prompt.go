@@ -0,0 +1,199 @@
+package services
+
+import (
+	"fmt"
+	"memoriva-backend/models"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const cardSelectionSystemPrompt = `You are an intelligent flashcard study assistant. Your task is to analyze flashcard data and select the most appropriate cards for study based on the user's request.
+
+You will receive:
+1. A collection of flashcards with their front/back content
+2. SRS metadata including review counts (easy, hard, again) and repetition data
+3. A user prompt describing what they want to study
+4. A maximum card limit (but you can select FEWER cards if the user's request is specific)
+
+Your job is to:
+1. Understand the user's study intent from their prompt
+2. Find cards semantically relevant to the user's prompt (prioritize relevance over quantity)
+3. Analyze card weakness based on SRS data (the weakness score estimates how likely the user has forgotten the card by now)
+4. Select the most appropriate cards - if the user asks for specific topics, only select cards related to those topics
+5. If only 2 cards match the user's specific request, return only those 2 cards (don't pad with unrelated cards)
+6. You can repeat very weak cards multiple times in the selection
+
+IMPORTANT: Quality over quantity - better to return 2 highly relevant cards than 20 loosely related ones.
+
+Respond with only a JSON object of this form, listing cards in the order they should be studied:
+{"cards": [{"cardId": "<flashcard ID>", "reason": "<short reason shown to the user>", "repeat": <true to show the card again later in the session>, "priority": <1 = essential, 2 = useful, 3 = optional>}]}`
+
+const (
+	// Card backs longer than this are cut short in prompts
+	maxCardBackTokens = 200
+	// Room reserved for the request header and footer around the card list
+	promptOverheadTokens = 300
+	// Least room for card entries, enough for a few cards per request so a
+	// small budget does not turn into one LLM call per card
+	minCardBudgetTokens = 1000
+)
+
+// Approximate characters per token for Latin text by model family. Other
+// scripts are counted as one token per character.
+var charsPerTokenByModel = map[string]float64{
+	"gpt":      4.0,
+	"text":     4.0,
+	"o1":       4.0,
+	"o3":       4.0,
+	"deepseek": 3.3,
+	"claude":   3.5,
+	"llama":    3.8,
+}
+
+const defaultCharsPerToken = 3.5
+
+// countTokens estimates how many tokens the model's tokenizer produces for text
+func countTokens(model, text string) int {
+	ratio := defaultCharsPerToken
+	lowerModel := strings.ToLower(model)
+	for prefix, r := range charsPerTokenByModel {
+		if strings.HasPrefix(lowerModel, prefix) {
+			ratio = r
+			break
+		}
+	}
+
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+
+	return int(float64(ascii)/ratio) + other + 1
+}
+
+// truncateToTokens shortens text to roughly the given number of tokens
+func truncateToTokens(model, text string, maxTokens int) string {
+	if countTokens(model, text) <= maxTokens {
+		return text
+	}
+
+	runes := []rune(text)
+	low, high := 0, len(runes)
+	for low < high {
+		mid := (low + high + 1) / 2
+		if countTokens(model, string(runes[:mid])) <= maxTokens {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return string(runes[:low]) + "…"
+}
+
+// cardPromptBuilder renders card selection prompts that fit a provider's token budget
+type cardPromptBuilder struct {
+	model    string
+	budget   int
+	weakness *WeaknessModel
+	now      time.Time
+}
+
+func newCardPromptBuilder(provider ChatProvider, weakness *WeaknessModel, now time.Time) *cardPromptBuilder {
+	return &cardPromptBuilder{
+		model:    provider.Model(),
+		budget:   provider.PromptBudget(),
+		weakness: weakness,
+		now:      now,
+	}
+}
+
+// minPromptBudget is the smallest prompt budget that leaves
+// minCardBudgetTokens for cards after the system prompt and overhead
+func minPromptBudget(model string) int {
+	return countTokens(model, cardSelectionSystemPrompt) + promptOverheadTokens + minCardBudgetTokens
+}
+
+// cardBudget is the number of tokens left for card entries. Budgets are
+// checked when providers are registered; the floor only guards providers
+// registered some other way.
+func (b *cardPromptBuilder) cardBudget() int {
+	return max(b.budget-countTokens(b.model, cardSelectionSystemPrompt)-promptOverheadTokens, minCardBudgetTokens)
+}
+
+func (b *cardPromptBuilder) formatCard(cardData models.CardWithMetadata) string {
+	weaknessScore := b.weakness.Score(cardData.Metadata, b.now)
+
+	return fmt.Sprintf(`
+ID: %s
+Front: %s
+Back: %s
+Weakness Score: %.2f (chance it is forgotten now: 0=strong, 1=very weak)
+Reviews: Easy=%d, Hard=%d, Again=%d
+`, cardData.Card.ID, cardData.Card.Front, truncateToTokens(b.model, cardData.Card.Back, maxCardBackTokens), weaknessScore,
+		getReviewCount(cardData.Metadata, "easy"),
+		getReviewCount(cardData.Metadata, "hard"),
+		getReviewCount(cardData.Metadata, "again"))
+}
+
+// chunk splits pre-ranked cards into consecutive groups that each fit the
+// budget, so the first chunk holds the best ranked cards. A single card that
+// exceeds the budget on its own still gets a chunk.
+func (b *cardPromptBuilder) chunk(cards []models.CardWithMetadata) [][]models.CardWithMetadata {
+	budget := b.cardBudget()
+
+	var chunks [][]models.CardWithMetadata
+	var current []models.CardWithMetadata
+	used := 0
+
+	for _, cardData := range cards {
+		tokens := countTokens(b.model, b.formatCard(cardData))
+		if len(current) > 0 && used+tokens > budget {
+			chunks = append(chunks, current)
+			current = nil
+			used = 0
+		}
+		current = append(current, cardData)
+		used += tokens
+	}
+
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// userPrompt renders the request for a final selection over the given cards
+func (b *cardPromptBuilder) userPrompt(prompt string, maxCards int, cards []models.CardWithMetadata) string {
+	return b.render(fmt.Sprintf(`User wants to study: "%s"
+Maximum cards: %d
+
+Available flashcards:
+`, prompt, maxCards), cards, "\nReturn the JSON object with the selected cards:")
+}
+
+// shortlistPrompt renders a map round request over one part of a deck that
+// is too large for a single prompt
+func (b *cardPromptBuilder) shortlistPrompt(prompt string, maxCards, part, parts int, cards []models.CardWithMetadata) string {
+	return b.render(fmt.Sprintf(`User wants to study: "%s"
+Maximum cards: %d
+
+The deck is too large to show at once. This is part %d of %d. Shortlist the cards from this part that are worth considering for the final selection; a later round will choose among all shortlisted cards.
+
+Available flashcards:
+`, prompt, maxCards, part, parts), cards, "\nReturn the JSON object with the shortlisted cards:")
+}
+
+func (b *cardPromptBuilder) render(header string, cards []models.CardWithMetadata, footer string) string {
+	var sb strings.Builder
+	sb.WriteString(header)
+	for _, cardData := range cards {
+		sb.WriteString(b.formatCard(cardData))
+	}
+	sb.WriteString(footer)
+	return sb.String()
+}
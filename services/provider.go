@@ -0,0 +1,248 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"memoriva-backend/config"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Tasks that can be routed to different providers with LLM_ROUTE_<TASK>
+const (
+	TaskCardSelection = "card_selection"
+)
+
+const (
+	ChatRoleSystem    = "system"
+	ChatRoleUser      = "user"
+	ChatRoleAssistant = "assistant"
+)
+
+type ChatMessage struct {
+	Role    string
+	Content string
+}
+
+type ChatRequest struct {
+	Messages    []ChatMessage
+	MaxTokens   int
+	Temperature float32
+	// ResponseSchema requests structured JSON output where the provider supports it
+	ResponseSchema *ResponseSchema
+}
+
+// ResponseSchema describes the JSON object a chat response must contain
+type ResponseSchema struct {
+	Name   string
+	Schema json.RawMessage
+}
+
+type ChatResponse struct {
+	Content string
+	Model   string
+}
+
+// ChatProvider is a chat completion backend such as DeepSeek, OpenAI,
+// Anthropic or a self-hosted OpenAI-compatible server
+type ChatProvider interface {
+	Name() string
+	Model() string
+	// PromptBudget is the number of input tokens a request may use
+	PromptBudget() int
+	Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error)
+}
+
+// ProviderHTTPError is returned when a provider answers with a non-success status
+type ProviderHTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ProviderHTTPError) Error() string {
+	return fmt.Sprintf("provider returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// ProviderRegistry holds the configured chat providers and decides which
+// ones serve each task
+type ProviderRegistry struct {
+	providers map[string]ChatProvider
+	order     []string
+	routes    map[string][]string
+}
+
+func NewProviderRegistry(providers []config.LLMProviderConfig, routes map[string][]string) (*ProviderRegistry, error) {
+	registry := &ProviderRegistry{
+		providers: make(map[string]ChatProvider),
+		routes:    routes,
+	}
+
+	for _, providerConfig := range providers {
+		provider, err := newChatProvider(providerConfig)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", providerConfig.Name, err)
+		}
+		if minimum := minPromptBudget(provider.Model()); provider.PromptBudget() < minimum {
+			return nil, fmt.Errorf("provider %s: prompt budget of %d tokens is below the %d needed for the system prompt and a few cards",
+				providerConfig.Name, provider.PromptBudget(), minimum)
+		}
+		registry.Register(provider)
+		log.Printf("Registered LLM provider %s (%s)", provider.Name(), provider.Model())
+	}
+
+	for task, names := range routes {
+		for _, name := range names {
+			if _, ok := registry.providers[name]; !ok {
+				log.Printf("LLM route %s references unavailable provider %s", task, name)
+			}
+		}
+	}
+
+	return registry, nil
+}
+
+// Register adds a provider, appending it to the default order
+func (r *ProviderRegistry) Register(provider ChatProvider) {
+	if _, exists := r.providers[provider.Name()]; !exists {
+		r.order = append(r.order, provider.Name())
+	}
+	r.providers[provider.Name()] = provider
+}
+
+func (r *ProviderRegistry) Get(name string) (ChatProvider, bool) {
+	provider, ok := r.providers[name]
+	return provider, ok
+}
+
+// All returns every registered provider in the default order
+func (r *ProviderRegistry) All() []ChatProvider {
+	providers := make([]ChatProvider, 0, len(r.order))
+	for _, name := range r.order {
+		providers = append(providers, r.providers[name])
+	}
+	return providers
+}
+
+// ForTask returns the providers to use for a task in preference order. Tasks
+// without a route use every registered provider.
+func (r *ProviderRegistry) ForTask(task string) []ChatProvider {
+	names, routed := r.routes[task]
+	if !routed {
+		names = r.order
+	}
+
+	var providers []ChatProvider
+	for _, name := range names {
+		if provider, ok := r.providers[name]; ok {
+			providers = append(providers, provider)
+		}
+	}
+	return providers
+}
+
+func newChatProvider(providerConfig config.LLMProviderConfig) (ChatProvider, error) {
+	switch providerConfig.Type {
+	case "openai":
+		return newOpenAIProvider(providerConfig), nil
+	case "anthropic":
+		return newAnthropicProvider(providerConfig), nil
+	default:
+		return nil, fmt.Errorf("unknown provider type %q", providerConfig.Type)
+	}
+}
+
+// openAIProvider talks to any OpenAI-compatible chat completions endpoint
+type openAIProvider struct {
+	name           string
+	model          string
+	promptBudget   int
+	timeout        time.Duration
+	responseFormat string
+	client         *openai.Client
+}
+
+func newOpenAIProvider(providerConfig config.LLMProviderConfig) *openAIProvider {
+	clientConfig := openai.DefaultConfig(providerConfig.APIKey)
+	if providerConfig.BaseURL != "" {
+		clientConfig.BaseURL = providerConfig.BaseURL
+	}
+
+	return &openAIProvider{
+		name:           providerConfig.Name,
+		model:          providerConfig.Model,
+		promptBudget:   providerConfig.PromptTokens,
+		timeout:        providerConfig.Timeout,
+		responseFormat: providerConfig.ResponseFormat,
+		client:         openai.NewClientWithConfig(clientConfig),
+	}
+}
+
+func (p *openAIProvider) Name() string {
+	return p.name
+}
+
+func (p *openAIProvider) Model() string {
+	return p.model
+}
+
+func (p *openAIProvider) PromptBudget() int {
+	return p.promptBudget
+}
+
+func (p *openAIProvider) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	messages := make([]openai.ChatCompletionMessage, 0, len(req.Messages))
+	for _, message := range req.Messages {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    message.Role,
+			Content: message.Content,
+		})
+	}
+
+	completionReq := openai.ChatCompletionRequest{
+		Model:       p.model,
+		Messages:    messages,
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
+	}
+
+	if req.ResponseSchema != nil {
+		switch p.responseFormat {
+		case "json_schema":
+			completionReq.ResponseFormat = &openai.ChatCompletionResponseFormat{
+				Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+				JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+					Name:   req.ResponseSchema.Name,
+					Schema: req.ResponseSchema.Schema,
+					Strict: true,
+				},
+			}
+		case "json_object":
+			completionReq.ResponseFormat = &openai.ChatCompletionResponseFormat{
+				Type: openai.ChatCompletionResponseFormatTypeJSONObject,
+			}
+		}
+	}
+
+	resp, err := p.client.CreateChatCompletion(ctx, completionReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("no response from %s", p.name)
+	}
+
+	return &ChatResponse{
+		Content: resp.Choices[0].Message.Content,
+		Model:   resp.Model,
+	}, nil
+}
@@ -2,73 +2,242 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"memoriva-backend/models"
+	"os"
 	"sync"
 	"time"
 )
 
-type StudySessionJob struct {
-	SessionID string
-	Timestamp time.Time
+// QueueConfig controls how workers poll and lock jobs in the durable queue
+type QueueConfig struct {
+	// PollInterval is how often idle workers check for new jobs
+	PollInterval time.Duration
+	// VisibilityTimeout is how long a claimed job stays locked without a
+	// heartbeat before another worker may take it over
+	VisibilityTimeout time.Duration
+	// MaxQueued rejects new jobs once this many are waiting
+	MaxQueued int
+	// MaxQueuedPerUser rejects new jobs from a user with this many waiting
+	MaxQueuedPerUser int
+	// MaxRunningPerUser caps how many of one user's jobs run at once, leaving
+	// workers free for other users
+	MaxRunningPerUser int
+	// RetryAfter is suggested to clients whose sessions were rejected
+	RetryAfter time.Duration
+	// Retry decides how often and when failed jobs run again
+	Retry RetryPolicy
+	// JobTimeout bounds a single attempt; a job that runs longer is aborted
+	// and retried like any other transient failure
+	JobTimeout time.Duration
 }
 
+// RetryPolicy retries transient failures with exponential backoff. Jitter
+// spreads retries by up to that fraction of the delay in either direction so
+// jobs that failed together do not retry together.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64
+}
+
+// Backoff returns the delay before the next run of a job that has already
+// been attempted the given number of times
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if p.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(delay))
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// QueueService processes study sessions from a job table in Postgres, so
+// queued work survives restarts and can be shared by several replicas
 type QueueService struct {
-	jobs        chan StudySessionJob
 	workers     int
+	workerID    string
+	config      QueueConfig
 	ragService  *RAGService
 	dbService   *DatabaseService
+	events      *EventBus
+	wake        chan struct{}
 	workerGroup sync.WaitGroup
 	ctx         context.Context
 	cancel      context.CancelFunc
+
+	// Closed once the service stops taking new work
+	draining  chan struct{}
+	drainOnce sync.Once
+
+	// Cancel functions of jobs running in this process, keyed by session ID
+	runningMu sync.Mutex
+	running   map[string]context.CancelCauseFunc
 }
 
-func NewQueueService(workers int, ragService *RAGService, dbService *DatabaseService) *QueueService {
+func NewQueueService(workers int, ragService *RAGService, dbService *DatabaseService, events *EventBus, config QueueConfig) *QueueService {
 	ctx, cancel := context.WithCancel(context.Background())
 
+	hostname, _ := os.Hostname()
+
 	return &QueueService{
-		jobs:       make(chan StudySessionJob, 100), // Buffer for 100 jobs
 		workers:    workers,
+		workerID:   fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), generateUUID()[:8]),
+		config:     config,
 		ragService: ragService,
 		dbService:  dbService,
+		events:     events,
+		wake:       make(chan struct{}, workers),
 		ctx:        ctx,
 		cancel:     cancel,
+		draining:   make(chan struct{}),
+		running:    make(map[string]context.CancelCauseFunc),
 	}
 }
 
 func (q *QueueService) Start() {
 	log.Printf("Starting queue service with %d workers", q.workers)
 
+	// Sessions stuck in PROCESSING lost their worker in a previous run
+	recovered, err := q.dbService.RequeueOrphanedSessions(q.ctx)
+	if err != nil {
+		log.Printf("Failed to recover orphaned sessions: %v", err)
+	} else if len(recovered) > 0 {
+		log.Printf("Requeued %d sessions left in PROCESSING: %v", len(recovered), recovered)
+	}
+
 	for i := 0; i < q.workers; i++ {
 		q.workerGroup.Add(1)
 		go q.worker(i)
 	}
 }
 
+// Stop aborts running jobs, handing them back to the queue, and waits for
+// the workers to exit
 func (q *QueueService) Stop() {
 	log.Println("Stopping queue service...")
+	q.Drain()
 	q.cancel()
-	close(q.jobs)
 	q.workerGroup.Wait()
 	log.Println("Queue service stopped")
 }
 
-func (q *QueueService) EnqueueStudySession(sessionID string) error {
-	job := StudySessionJob{
-		SessionID: sessionID,
-		Timestamp: time.Now(),
+// Drain stops accepting new sessions and claiming queued jobs. Queued jobs
+// stay in Postgres for the next worker to start.
+func (q *QueueService) Drain() {
+	q.drainOnce.Do(func() {
+		log.Println("Draining queue service...")
+		close(q.draining)
+	})
+}
+
+// RetryAfter is how long clients should wait before resubmitting a
+// rejected session
+func (q *QueueService) RetryAfter() time.Duration {
+	return q.config.RetryAfter
+}
+
+// Draining reports whether the service has stopped taking new work
+func (q *QueueService) Draining() bool {
+	select {
+	case <-q.draining:
+		return true
+	default:
+		return false
 	}
+}
+
+// Shutdown drains the queue and waits for running sessions to finish. If
+// ctx expires first, the remaining jobs are aborted and handed back to the
+// queue without using up an attempt.
+func (q *QueueService) Shutdown(ctx context.Context) error {
+	q.Drain()
+
+	done := make(chan struct{})
+	go func() {
+		q.workerGroup.Wait()
+		close(done)
+	}()
 
 	select {
-	case q.jobs <- job:
-		log.Printf("Enqueued study session: %s", sessionID)
+	case <-done:
+		q.cancel()
+		log.Println("Queue service stopped")
 		return nil
-	case <-q.ctx.Done():
-		return q.ctx.Err()
-	default:
+	case <-ctx.Done():
+		log.Println("Grace period expired, releasing running jobs")
+		q.Stop()
+		return ctx.Err()
+	}
+}
+
+// EnqueueStudySession queues a session at the given priority. Enqueueing is
+// idempotent: if the session already has a queued or running job, or the
+// user already sent the idempotency key, that job is returned with created
+// false and options are not saved. It returns ErrSessionCancelled for a
+// cancelled session, and ErrUserQueueFull or ErrQueueFull when the per-user
+// or global limit on waiting jobs is reached.
+func (q *QueueService) EnqueueStudySession(ctx context.Context, sessionID string, priority int, idempotencyKey string, options SessionOptions) (job *models.StudySessionJob, created bool, err error) {
+	if q.Draining() {
+		return nil, false, ErrQueueDraining
+	}
+
+	session, err := q.dbService.GetStudySession(ctx, sessionID)
+	if err != nil {
+		return nil, false, err
+	}
+	if session.Status == models.SessionStatusCancelled {
+		return nil, false, ErrSessionCancelled
+	}
+
+	existing, err := q.dbService.FindExistingJob(ctx, session, idempotencyKey)
+	if err != nil {
+		return nil, false, err
+	}
+	if existing != nil {
+		log.Printf("Session %s already has job %s (%s), not enqueueing again", sessionID, existing.ID, existing.Status)
+		return existing, false, nil
+	}
+
+	job, created, err = q.dbService.EnqueueJob(ctx, session, priority, idempotencyKey, options, QueueLimits{
+		MaxQueued:        q.config.MaxQueued,
+		MaxQueuedPerUser: q.config.MaxQueuedPerUser,
+	})
+	switch {
+	case errors.Is(err, ErrUserQueueFull):
+		log.Printf("User %s has too many sessions queued, rejecting session: %s", session.UserID, sessionID)
+		return nil, false, err
+	case errors.Is(err, ErrQueueFull):
 		log.Printf("Queue is full, rejecting session: %s", sessionID)
-		return ErrQueueFull
+		return nil, false, err
+	case err != nil:
+		return nil, false, fmt.Errorf("failed to enqueue session: %w", err)
+	}
+	if !created {
+		return job, false, nil
+	}
+	log.Printf("Enqueued study session: %s (priority %d)", sessionID, priority)
+	q.events.Publish(SessionEvent{SessionID: sessionID, Stage: StageQueued})
+
+	// Wake an idle local worker instead of waiting for the next poll
+	select {
+	case q.wake <- struct{}{}:
+	default:
 	}
+	return job, true, nil
 }
 
 func (q *QueueService) worker(workerID int) {
@@ -76,38 +245,235 @@ func (q *QueueService) worker(workerID int) {
 
 	log.Printf("Worker %d started", workerID)
 
+	ticker := time.NewTicker(q.config.PollInterval)
+	defer ticker.Stop()
+
 	for {
-		select {
-		case job, ok := <-q.jobs:
-			if !ok {
-				log.Printf("Worker %d: channel closed, exiting", workerID)
-				return
-			}
+		if q.Draining() {
+			log.Printf("Worker %d: queue draining, exiting", workerID)
+			return
+		}
+
+		job, err := q.dbService.ClaimJob(q.ctx, q.workerID, q.config.VisibilityTimeout, q.config.MaxRunningPerUser)
+		if err != nil {
+			log.Printf("Worker %d: failed to claim job: %v", workerID, err)
+		}
 
-			log.Printf("Worker %d processing session: %s", workerID, job.SessionID)
+		if job != nil {
+			log.Printf("Worker %d processing session: %s (attempt %d)", workerID, job.SessionID, job.Attempts)
 			q.processStudySession(workerID, job)
+			continue
+		}
 
-		case <-q.ctx.Done():
-			log.Printf("Worker %d: context cancelled, exiting", workerID)
-			return
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+		case <-q.draining:
 		}
 	}
 }
 
-func (q *QueueService) processStudySession(workerID int, job StudySessionJob) {
+func (q *QueueService) processStudySession(workerID int, job *models.StudySessionJob) {
 	sessionID := job.SessionID
 
+	ctx, cancel := context.WithCancelCause(q.ctx)
+	defer cancel(nil)
+	if q.config.JobTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, q.config.JobTimeout)
+		defer cancelTimeout()
+	}
+
+	q.runningMu.Lock()
+	q.running[sessionID] = cancel
+	q.runningMu.Unlock()
+	defer func() {
+		q.runningMu.Lock()
+		delete(q.running, sessionID)
+		q.runningMu.Unlock()
+	}()
+
+	// Keep the job locked while it runs
+	heartbeatDone := make(chan struct{})
+	defer close(heartbeatDone)
+	go q.heartbeat(workerID, job, cancel, heartbeatDone)
+
 	// Process with RAG service (which handles all the logic internally)
-	err := q.ragService.ProcessStudySession(sessionID)
-	if err != nil {
+	err := q.ragService.ProcessStudySession(ctx, sessionID, job.Attempts)
+
+	// Job bookkeeping must outlive the job's own context
+	bookkeeping := context.Background()
+
+	switch cause := context.Cause(ctx); {
+	case err == nil:
+		if err := q.dbService.FinishJob(bookkeeping, job.ID, q.workerID, models.JobStatusDone, nil); err != nil {
+			log.Printf("Worker %d: failed to complete job %s: %v", workerID, job.ID, err)
+		}
+		log.Printf("Worker %d: Successfully processed study session %s", workerID, sessionID)
+
+	case errors.Is(err, ErrSessionCancelled) || errors.Is(cause, ErrSessionCancelled):
+		// CancelStudySession usually marked the job CANCELLED already, but a job
+		// enqueued for a session cancelled earlier is still ours to finish;
+		// left RUNNING it would be reclaimed forever and block the session
+		err := q.dbService.FinishJob(bookkeeping, job.ID, q.workerID, models.JobStatusCancelled, nil)
+		if err != nil && !errors.Is(err, ErrJobLockLost) {
+			log.Printf("Worker %d: failed to mark job %s cancelled: %v", workerID, job.ID, err)
+		}
+		q.events.Publish(SessionEvent{SessionID: sessionID, Stage: StageCancelled, Attempt: job.Attempts})
+		log.Printf("Worker %d: session %s was cancelled", workerID, sessionID)
+
+	case errors.Is(cause, ErrJobLockLost):
+		log.Printf("Worker %d: abandoned session %s: %v", workerID, sessionID, cause)
+
+	case q.ctx.Err() != nil:
+		// Shutting down; hand the job back so it runs again right away
+		if err := q.dbService.ReleaseJob(bookkeeping, job.ID, q.workerID); err != nil {
+			log.Printf("Worker %d: failed to release job %s: %v", workerID, job.ID, err)
+		}
+		q.events.Publish(SessionEvent{SessionID: sessionID, Stage: StageQueued, Attempt: job.Attempts, Error: "worker stopped"})
+		log.Printf("Worker %d: released session %s for another worker", workerID, sessionID)
+
+	case errors.Is(cause, context.DeadlineExceeded):
+		log.Printf("Worker %d: session %s timed out after %v", workerID, sessionID, q.config.JobTimeout)
+		q.handleFailure(workerID, job, fmt.Errorf("timed out after %v: %w", q.config.JobTimeout, cause))
+
+	default:
 		log.Printf("Worker %d: RAG processing failed for session %s: %v", workerID, sessionID, err)
+		q.handleFailure(workerID, job, err)
+	}
+}
+
+// CancelStudySession marks a session CANCELLED and aborts its job. A job
+// running in this process stops immediately; one running on another replica
+// stops at its next heartbeat.
+func (q *QueueService) CancelStudySession(ctx context.Context, sessionID string) error {
+	if err := q.dbService.CancelStudySession(ctx, sessionID); err != nil {
+		return err
+	}
+
+	q.runningMu.Lock()
+	cancel, ok := q.running[sessionID]
+	q.runningMu.Unlock()
+	if ok {
+		cancel(ErrSessionCancelled)
+	} else {
+		q.events.Publish(SessionEvent{SessionID: sessionID, Stage: StageCancelled})
+	}
+
+	log.Printf("Cancelled study session: %s", sessionID)
+	return nil
+}
+
+// handleFailure schedules a retry for transient errors and dead-letters jobs
+// that failed permanently or ran out of attempts
+func (q *QueueService) handleFailure(workerID int, job *models.StudySessionJob, jobErr error) {
+	reason := ""
+	switch {
+	case IsPermanent(jobErr):
+		reason = models.DeadLetterPermanent
+	case job.Attempts >= q.config.Retry.MaxAttempts:
+		reason = models.DeadLetterRetriesExhausted
+	}
+
+	q.recordFailure(job, jobErr)
+
+	if reason == "" {
+		delay := q.config.Retry.Backoff(job.Attempts)
+		retryAt := time.Now().Add(delay)
+		if err := q.dbService.RetryJob(context.Background(), job.ID, q.workerID, retryAt, jobErr); err != nil {
+			log.Printf("Worker %d: failed to schedule retry of job %s: %v", workerID, job.ID, err)
+			return
+		}
+		q.events.Publish(SessionEvent{SessionID: job.SessionID, Stage: StageQueued, Attempt: job.Attempts, RetryAt: &retryAt, Error: ErrorMessage(ErrorCode(jobErr))})
+		log.Printf("Worker %d: session %s will be retried in %v (attempt %d of %d)",
+			workerID, job.SessionID, delay.Round(time.Second), job.Attempts, q.config.Retry.MaxAttempts)
+		return
+	}
+
+	if err := q.dbService.DeadLetterJob(context.Background(), job, q.workerID, reason, jobErr); err != nil {
+		log.Printf("Worker %d: failed to dead-letter job %s: %v", workerID, job.ID, err)
 		return
 	}
+	q.events.Publish(SessionEvent{SessionID: job.SessionID, Stage: StageFailed, Attempt: job.Attempts, Error: ErrorMessage(ErrorCode(jobErr))})
+	log.Printf("Worker %d: session %s moved to dead-letter store (%s)", workerID, job.SessionID, reason)
+}
+
+// recordFailure stores the error code of a failed attempt and a message for
+// it for the status API
+func (q *QueueService) recordFailure(job *models.StudySessionJob, jobErr error) {
+	code := ErrorCode(jobErr)
+	reason := ErrorMessage(code)
+	result := &models.StudySessionResult{
+		SessionID:     job.SessionID,
+		Attempt:       job.Attempts,
+		ErrorCode:     &code,
+		FailureReason: &reason,
+	}
+	if err := q.dbService.SaveStudySessionResult(context.Background(), result); err != nil {
+		log.Printf("Failed to record result of session %s: %v", job.SessionID, err)
+	}
+}
+
+// RequeueDeadLetter gives a dead-lettered session a fresh job
+func (q *QueueService) RequeueDeadLetter(ctx context.Context, id string) (*models.StudySessionJob, error) {
+	job, err := q.dbService.RequeueDeadLetter(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Requeued dead-lettered session %s", job.SessionID)
+	q.events.Publish(SessionEvent{SessionID: job.SessionID, Stage: StageQueued})
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// heartbeat renews the job lock until done is closed. If the lock is lost,
+// because the job was cancelled or taken over by another worker, the job's
+// context is cancelled.
+func (q *QueueService) heartbeat(workerID int, job *models.StudySessionJob, cancel context.CancelCauseFunc, done <-chan struct{}) {
+	ticker := time.NewTicker(q.config.VisibilityTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := q.dbService.HeartbeatJob(q.ctx, job.ID, q.workerID, q.config.VisibilityTimeout)
+			if errors.Is(err, ErrJobLockLost) {
+				cancel(q.lostLockCause(job))
+				return
+			}
+			if err != nil {
+				log.Printf("Worker %d: heartbeat failed for job %s: %v", workerID, job.ID, err)
+			}
+		}
+	}
+}
 
-	log.Printf("Worker %d: Successfully processed study session %s", workerID, sessionID)
+// lostLockCause tells a job cancelled through another replica apart from one
+// whose lock expired and was claimed again
+func (q *QueueService) lostLockCause(job *models.StudySessionJob) error {
+	session, err := q.dbService.GetStudySession(q.ctx, job.SessionID)
+	if err == nil && session.Status == models.SessionStatusCancelled {
+		return ErrSessionCancelled
+	}
+	return ErrJobLockLost
 }
 
 // Custom errors
 var (
-	ErrQueueFull = fmt.Errorf("queue is full")
+	ErrQueueFull       = fmt.Errorf("queue is full")
+	ErrUserQueueFull   = fmt.Errorf("too many study sessions queued for this user")
+	ErrQueueDraining   = fmt.Errorf("queue is shutting down")
+	ErrJobLockLost     = fmt.Errorf("job lock lost to another worker")
+	ErrAlreadyRequeued = fmt.Errorf("dead letter has already been requeued")
+	ErrAlreadyQueued   = fmt.Errorf("study session is already queued or running")
+
+	ErrSessionCancelled      = fmt.Errorf("study session was cancelled")
+	ErrSessionNotCancellable = fmt.Errorf("study session has already finished")
+	ErrIdempotencyKeyReused  = fmt.Errorf("idempotency key was already used for another session")
 )
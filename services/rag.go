@@ -1,77 +1,386 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"memoriva-backend/models"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
 )
 
+// Threshold used when reporting ranking statistics
+const semanticCardThreshold = 0.3
+
+// RankingConfig controls how lexical and semantic retrieval are fused and
+// how much SRS weakness contributes to the final card ranking
+type RankingConfig struct {
+	SemanticWeight float64
+	LexicalWeight  float64
+	WeaknessWeight float64
+	// RRFK dampens the advantage of top ranks in reciprocal rank fusion
+	RRFK float64
+	// CandidateLimit caps how many ranked cards are offered to the LLM, which
+	// then fits as many as its prompt budget allows
+	CandidateLimit int
+}
+
 type RAGService struct {
-	dbService        *DatabaseService
-	llmService       *LLMService
-	embeddingService *EmbeddingService
+	dbService  *DatabaseService
+	llmService *LLMService
+	embedder   Embedder
+	ranking    RankingConfig
+	events     *EventBus
+	weakness   *WeaknessModel
 }
 
-func NewRAGService(dbService *DatabaseService, llmService *LLMService, embeddingService *EmbeddingService) *RAGService {
+func NewRAGService(dbService *DatabaseService, llmService *LLMService, embedder Embedder, ranking RankingConfig, weakness *WeaknessModel, events *EventBus) *RAGService {
 	return &RAGService{
-		dbService:        dbService,
-		llmService:       llmService,
-		embeddingService: embeddingService,
+		dbService:  dbService,
+		llmService: llmService,
+		embedder:   embedder,
+		ranking:    ranking,
+		events:     events,
+		weakness:   weakness,
 	}
 }
 
-func (s *RAGService) ProcessStudySession(sessionID string) error {
+// ProcessStudySession selects and stores the cards for a session. Failures
+// that a retry cannot fix are wrapped with Permanent; marking the session
+// FAILED is left to the queue, which may retry transient errors first.
+// Cancelling ctx aborts any database, embedding or LLM call in progress.
+// Each stage is published to the event bus as it starts.
+func (s *RAGService) ProcessStudySession(ctx context.Context, sessionID string, attempt int) error {
+	progress := newSessionProgress(s.events, sessionID, attempt)
+
 	// Get study session details first to validate it exists
-	session, err := s.dbService.GetStudySession(sessionID)
+	session, err := s.dbService.GetStudySession(ctx, sessionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Permanent(fmt.Errorf("%w: %v", ErrSessionNotFound, err))
+	}
 	if err != nil {
 		return fmt.Errorf("failed to get session: %w", err)
 	}
 
 	// Update status to PROCESSING
-	err = s.dbService.UpdateStudySessionStatus(sessionID, "PROCESSING")
+	err = s.dbService.StartStudySession(ctx, sessionID)
 	if err != nil {
 		return fmt.Errorf("failed to update session status: %w", err)
 	}
 
 	// Get deck cards with metadata
-	cards, err := s.dbService.GetDeckCardsWithMetadata(session.DeckID, session.UserID)
+	progress.enter(SessionEvent{Stage: StageLoadingCards})
+	cards, err := s.dbService.GetDeckCardsWithMetadata(ctx, session.DeckID, session.UserID)
 	if err != nil {
-		s.dbService.UpdateStudySessionStatus(sessionID, "FAILED")
 		return fmt.Errorf("failed to get deck cards: %w", err)
 	}
 
 	if len(cards) == 0 {
-		s.dbService.UpdateStudySessionStatus(sessionID, "FAILED")
-		return fmt.Errorf("no cards found in deck")
+		return Permanent(ErrEmptyDeck)
+	}
+
+	if session.DueOnly {
+		cards, err = s.dueCards(ctx, session, cards)
+		if err != nil {
+			return fmt.Errorf("failed to get due cards: %w", err)
+		}
+		if len(cards) == 0 {
+			return Permanent(ErrNoDueCards)
+		}
 	}
 
+	// Embed the prompt and any cards whose text changed
+	progress.enter(SessionEvent{Stage: StageEmbedding, TotalCards: len(cards)})
+	semantic := s.semanticSimilarities(ctx, session, cards)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Rank cards by prompt relevance and weakness, keeping only the best candidates for the LLM
+	progress.enter(SessionEvent{Stage: StageRanking})
+	ranking := s.rankCards(session, cards, semantic)
+	candidates := topCandidates(ranking.SelectedCards, s.ranking.CandidateLimit)
+	log.Printf("Ranked %d cards for session %s (weak: %d, semantic: %d), sending %d candidates to LLM",
+		ranking.TotalCards, sessionID, ranking.WeakCards, ranking.SemanticCards, len(candidates))
+
 	// Use LLM to analyze and select cards
-	selectedCardIDs, err := s.llmService.AnalyzeCardsForStudy(cards, session.Prompt, session.MaxCards)
+	progress.enter(SessionEvent{Stage: StageLLMSelection, CandidateCards: len(candidates)})
+	selection, err := s.llmService.AnalyzeCardsForStudy(ctx, candidates, session.Prompt, session.MaxCards)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != nil {
 		log.Printf("LLM analysis failed, using fallback: %v", err)
 		// Use fallback selection if LLM fails
-		selectedCardIDs = s.fallbackSelection(cards, session.MaxCards)
+		selection = &models.CardSelectionResult{
+			Selections:   s.fallbackSelection(candidates, session.MaxCards),
+			UsedFallback: true,
+		}
 	}
+	selections := selection.Selections
 
-	// Create study session cards
-	err = s.dbService.CreateStudySessionCards(sessionID, selectedCardIDs)
-	if err != nil {
-		s.dbService.UpdateStudySessionStatus(sessionID, "FAILED")
-		return fmt.Errorf("failed to create session cards: %w", err)
+	scores := make(map[string]float64, len(ranking.SelectedCards))
+	for _, score := range ranking.SelectedCards {
+		scores[score.Card.ID] = score.CombinedScore
+	}
+	for i := range selections {
+		selections[i].Score = scores[selections[i].CardID]
 	}
 
-	// Mark session as complete
-	err = s.dbService.CompleteStudySession(sessionID)
+	// Store the cards and mark the session as complete
+	progress.enter(SessionEvent{Stage: StagePersisting, SelectedCards: len(selections), UsedFallback: selection.UsedFallback})
+	result := &models.StudySessionResult{
+		SessionID:    sessionID,
+		Attempt:      attempt,
+		UsedFallback: selection.UsedFallback,
+	}
+	if selection.Provider != "" {
+		result.Provider = &selection.Provider
+		result.Model = &selection.Model
+	}
+	err = s.dbService.CompleteStudySession(ctx, sessionID, selections, result)
 	if err != nil {
 		return fmt.Errorf("failed to complete session: %w", err)
 	}
+	progress.enter(SessionEvent{Stage: StageReady})
 
-	log.Printf("Successfully processed study session %s with %d cards", sessionID, len(selectedCardIDs))
+	log.Printf("Successfully processed study session %s with %d cards", sessionID, len(selections))
 	return nil
 }
 
-func (s *RAGService) fallbackSelection(cards []models.CardWithMetadata, maxCards int) []string {
-	var selectedIDs []string
+// rankCards scores every card by prompt relevance and SRS weakness, returning
+// them sorted by combined score. Relevance fuses BM25 keyword matches with
+// the given embedding similarities through reciprocal rank fusion; when
+// semantic is nil only the keyword ranking is used.
+func (s *RAGService) rankCards(session *models.StudySession, cards []models.CardWithMetadata, semantic map[string]float64) *models.RAGResult {
+	result := &models.RAGResult{
+		SelectedCards: make([]models.CardScore, 0, len(cards)),
+		TotalCards:    len(cards),
+	}
+
+	flashcards := make([]models.Flashcard, 0, len(cards))
+	for _, cardData := range cards {
+		flashcards = append(flashcards, cardData.Card)
+	}
+
+	lexical := NewBM25Index(flashcards).Score(session.Prompt)
+
+	rankings := []weightedRanking{{scores: lexical, weight: s.ranking.LexicalWeight}}
+	if semantic != nil {
+		rankings = append(rankings, weightedRanking{scores: semantic, weight: s.ranking.SemanticWeight})
+	}
+	relevance := reciprocalRankFusion(rankings, s.ranking.RRFK)
+
+	now := time.Now()
+	for _, cardData := range cards {
+		score := models.CardScore{
+			Card:          cardData.Card,
+			Metadata:      cardData.Metadata,
+			WeaknessScore: s.weakness.Score(cardData.Metadata, now),
+			SemanticScore: semantic[cardData.Card.ID],
+			LexicalScore:  lexical[cardData.Card.ID],
+		}
+		score.CombinedScore = (1-s.ranking.WeaknessWeight)*relevance[cardData.Card.ID] + s.ranking.WeaknessWeight*score.WeaknessScore
+
+		if score.WeaknessScore > s.weakness.WeakThreshold {
+			result.WeakCards++
+		}
+		if score.SemanticScore > semanticCardThreshold {
+			result.SemanticCards++
+		}
+		if score.LexicalScore > 0 {
+			result.LexicalCards++
+		}
+
+		result.SelectedCards = append(result.SelectedCards, score)
+	}
+
+	sort.SliceStable(result.SelectedCards, func(i, j int) bool {
+		return result.SelectedCards[i].CombinedScore > result.SelectedCards[j].CombinedScore
+	})
+
+	return result
+}
+
+type weightedRanking struct {
+	scores map[string]float64
+	weight float64
+}
+
+// reciprocalRankFusion merges several score maps by rank rather than raw
+// score, so BM25 and cosine similarity can be combined despite their
+// different scales. Results are normalised so a card ranked first everywhere
+// scores 1.
+func reciprocalRankFusion(rankings []weightedRanking, k float64) map[string]float64 {
+	fused := make(map[string]float64)
+	maxScore := 0.0
+
+	for _, ranking := range rankings {
+		if ranking.weight <= 0 || len(ranking.scores) == 0 {
+			continue
+		}
+
+		ids := make([]string, 0, len(ranking.scores))
+		for id, score := range ranking.scores {
+			if score > 0 {
+				ids = append(ids, id)
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			if ranking.scores[ids[i]] != ranking.scores[ids[j]] {
+				return ranking.scores[ids[i]] > ranking.scores[ids[j]]
+			}
+			return ids[i] < ids[j]
+		})
+
+		for rank, id := range ids {
+			fused[id] += ranking.weight / (k + float64(rank+1))
+		}
+		maxScore += ranking.weight / (k + 1)
+	}
+
+	if maxScore > 0 {
+		for id := range fused {
+			fused[id] /= maxScore
+		}
+	}
+	return fused
+}
+
+// semanticSimilarities returns the prompt similarity of each card keyed by
+// card ID, or nil when the prompt cannot be embedded
+func (s *RAGService) semanticSimilarities(ctx context.Context, session *models.StudySession, cards []models.CardWithMetadata) map[string]float64 {
+	promptEmbedding, err := s.embedder.GetPromptEmbedding(ctx, session.Prompt)
+	if err != nil {
+		log.Printf("Prompt embedding unavailable, ranking without semantic similarity: %v", err)
+		return nil
+	}
+
+	if err := s.refreshCardEmbeddings(ctx, cards); err != nil {
+		log.Printf("Failed to refresh card embeddings, ranking without semantic similarity: %v", err)
+		return nil
+	}
+
+	nearest, err := s.dbService.NearestDeckCards(ctx, session.DeckID, s.embedder.Model(), promptEmbedding, len(cards))
+	if err != nil {
+		log.Printf("Nearest neighbour search failed, ranking without semantic similarity: %v", err)
+		return nil
+	}
+
+	similarities := make(map[string]float64, len(nearest))
+	for _, match := range nearest {
+		similarities[match.FlashcardID] = match.Similarity
+	}
+	return similarities
+}
+
+// refreshCardEmbeddings embeds cards that have no stored vector or whose
+// Front/Back text changed since the vector was computed
+func (s *RAGService) refreshCardEmbeddings(ctx context.Context, cards []models.CardWithMetadata) error {
+	model := s.embedder.Model()
+
+	cardIDs := make([]string, 0, len(cards))
+	for _, cardData := range cards {
+		cardIDs = append(cardIDs, cardData.Card.ID)
+	}
+
+	stored, err := s.dbService.GetCardEmbeddings(ctx, cardIDs, model)
+	if err != nil {
+		return fmt.Errorf("failed to load card embeddings: %w", err)
+	}
+
+	var stale []models.Flashcard
+	for _, cardData := range cards {
+		existing, ok := stored[cardData.Card.ID]
+		if !ok || existing.ContentHash != cardContentHash(cardData.Card) {
+			stale = append(stale, cardData.Card)
+		}
+	}
+
+	if len(stale) == 0 {
+		return nil
+	}
+
+	vectors, cardErrors := s.embedder.GetCardEmbeddings(ctx, stale)
+	for cardID, err := range cardErrors {
+		log.Printf("Failed to embed %d cards (e.g. card %s: %v)", len(cardErrors), cardID, err)
+		break
+	}
+
+	refreshed := 0
+	for i, card := range stale {
+		if vectors[i] == nil {
+			continue
+		}
+
+		embedding := models.CardEmbedding{
+			FlashcardID: card.ID,
+			Model:       model,
+			ContentHash: cardContentHash(card),
+			Embedding:   vectors[i],
+		}
+		if err := s.dbService.SaveCardEmbedding(ctx, &embedding); err != nil {
+			return fmt.Errorf("failed to save embedding for card %s: %w", card.ID, err)
+		}
+		refreshed++
+	}
+
+	log.Printf("Refreshed %d of %d stale card embeddings", refreshed, len(stale))
+	return nil
+}
+
+// topCandidates returns the highest ranked cards
+func topCandidates(ranked []models.CardScore, limit int) []models.CardWithMetadata {
+	if limit <= 0 || limit > len(ranked) {
+		limit = len(ranked)
+	}
+
+	candidates := make([]models.CardWithMetadata, 0, limit)
+	for _, score := range ranked[:limit] {
+		candidates = append(candidates, models.CardWithMetadata{
+			Card:     score.Card,
+			Metadata: score.Metadata,
+		})
+	}
+
+	return candidates
+}
+
+// dueCards keeps the cards in the user's due queue for today in the
+// session's time zone, including new cards within the user's daily limit
+func (s *RAGService) dueCards(ctx context.Context, session *models.StudySession, cards []models.CardWithMetadata) ([]models.CardWithMetadata, error) {
+	loc, err := time.LoadLocation(session.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	dayStart, dayEnd := DayBounds(time.Now(), loc)
+	queue, err := s.dbService.GetDueQueue(ctx, session.UserID, session.DeckID, dayStart, dayEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	due := make(map[string]bool, len(queue.Reviews)+len(queue.New))
+	for _, card := range queue.Reviews {
+		due[card.Card.ID] = true
+	}
+	for _, card := range queue.New {
+		due[card.Card.ID] = true
+	}
+
+	filtered := make([]models.CardWithMetadata, 0, len(due))
+	for _, card := range cards {
+		if due[card.Card.ID] {
+			filtered = append(filtered, card)
+		}
+	}
+	return filtered, nil
+}
+
+func (s *RAGService) fallbackSelection(cards []models.CardWithMetadata, maxCards int) []models.CardSelection {
+	var selections []models.CardSelection
 
 	// Simple fallback: prioritize cards with metadata (reviewed cards) and weak cards
 	reviewedCards := make([]models.CardWithMetadata, 0)
@@ -86,33 +395,27 @@ func (s *RAGService) fallbackSelection(cards []models.CardWithMetadata, maxCards
 	}
 
 	// Add reviewed cards first (prioritizing weak ones)
+	now := time.Now()
 	for _, card := range reviewedCards {
-		if len(selectedIDs) >= maxCards {
+		if len(selections) >= maxCards {
 			break
 		}
 
-		selectedIDs = append(selectedIDs, card.Card.ID)
+		selections = append(selections, models.CardSelection{CardID: card.Card.ID, Reason: "Previously reviewed card", Priority: 1})
 
-		// Check if this is a very weak card (high again count)
-		if card.Metadata != nil {
-			total := card.Metadata.EasyReviewCount + card.Metadata.HardReviewCount + card.Metadata.AgainReviewCount
-			if total > 0 {
-				againRatio := float64(card.Metadata.AgainReviewCount) / float64(total)
-				if againRatio > 0.5 && len(selectedIDs) < maxCards {
-					// Repeat very weak cards
-					selectedIDs = append(selectedIDs, card.Card.ID)
-				}
-			}
+		// Repeat cards that are probably forgotten by now
+		if s.weakness.NeedsRepeat(card.Metadata, now) && len(selections) < maxCards {
+			selections = append(selections, models.CardSelection{CardID: card.Card.ID, Reason: "Likely forgotten by now, repeated for practice", Priority: 1, Repeat: true})
 		}
 	}
 
 	// Fill remaining slots with new cards
 	for _, card := range newCards {
-		if len(selectedIDs) >= maxCards {
+		if len(selections) >= maxCards {
 			break
 		}
-		selectedIDs = append(selectedIDs, card.Card.ID)
+		selections = append(selections, models.CardSelection{CardID: card.Card.ID, Reason: "New card", Priority: 2})
 	}
 
-	return selectedIDs
+	return selections
 }
@@ -0,0 +1,251 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"memoriva-backend/models"
+	"memoriva-backend/scheduler"
+	"time"
+)
+
+var (
+	ErrCardNotInSession = fmt.Errorf("card is not part of the study session")
+	ErrReplayStale      = fmt.Errorf("card was reviewed during the replay")
+)
+
+// ReviewService records card reviews and reschedules the cards with the
+// scheduler each user picked
+type ReviewService struct {
+	dbService *DatabaseService
+}
+
+func NewReviewService(dbService *DatabaseService) *ReviewService {
+	return &ReviewService{
+		dbService: dbService,
+	}
+}
+
+// SchedulerFor returns the scheduler the user picked in their preferences
+func (s *ReviewService) SchedulerFor(ctx context.Context, userID string) (scheduler.Scheduler, error) {
+	preference, err := s.dbService.GetUserPreference(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scheduler.ByName(preference.Scheduler)
+}
+
+// SubmitReview records a review of a card by the user, logs it and returns
+// the card's updated metadata and the scheduler that produced it
+func (s *ReviewService) SubmitReview(ctx context.Context, userID string, req models.SubmitReviewRequest) (*models.SRSCardMetadata, scheduler.Scheduler, error) {
+	grade := scheduler.Grade(req.Grade)
+	if !grade.Valid() {
+		return nil, nil, fmt.Errorf("invalid grade %q", req.Grade)
+	}
+
+	sched, err := s.SchedulerFor(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+
+	entry := &models.ReviewLog{
+		UserID:           userID,
+		FlashcardID:      req.FlashcardID,
+		SessionID:        req.StudySessionID,
+		Grade:            req.Grade,
+		ResponseMs:       req.ResponseTimeMs,
+		Scheduler:        sched.Name(),
+		SchedulerVersion: sched.Version(),
+		ReviewedAt:       now,
+	}
+	metadata, err := s.dbService.RecordReview(ctx, entry, func(metadata *models.SRSCardMetadata) {
+		applyReview(metadata, sched, grade, now)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return metadata, sched, nil
+}
+
+// applyReview reschedules a card and counts the answer
+func applyReview(metadata *models.SRSCardMetadata, sched scheduler.Scheduler, grade scheduler.Grade, now time.Time) {
+	state := sched.Review(schedulerState(metadata), grade, now)
+
+	metadata.EaseFactor = state.EaseFactor
+	metadata.Interval = state.Interval
+	metadata.Repetitions = state.Repetitions
+	metadata.LastReviewed = state.LastReviewed
+	metadata.NextReview = state.NextReview
+	if state.Stability > 0 {
+		metadata.Stability = &state.Stability
+		metadata.Difficulty = &state.Difficulty
+	} else {
+		metadata.Stability = nil
+		metadata.Difficulty = nil
+	}
+
+	switch grade {
+	case scheduler.Again:
+		metadata.AgainReviewCount++
+	case scheduler.Hard:
+		metadata.HardReviewCount++
+	case scheduler.Easy:
+		metadata.EasyReviewCount++
+	}
+}
+
+// ReplayOptions selects what Replay rebuilds and with which scheduler
+type ReplayOptions struct {
+	// UserID limits the replay to one user; empty replays everyone
+	UserID string
+	// Scheduler forces one scheduler for everyone and switches the replayed
+	// users' preference to it, so their next reviews use it too; empty uses
+	// each user's preference
+	Scheduler string
+	// DryRun computes the new state without writing it
+	DryRun bool
+}
+
+// ReplayResult counts what a replay did
+type ReplayResult struct {
+	Users   int
+	Reviews int
+	Cards   int
+	Rebuilt int
+	// Cards whose log does not start with their first review, because they
+	// were reviewed before the log existed, are left untouched
+	Partial int
+	// Cards reviewed again while the replay ran are left untouched
+	Stale int
+}
+
+// Replay rebuilds SRSCardMetadata from the review log by running every
+// card's reviews through a scheduler in order, so a change of algorithm
+// applies to the whole history. When the scheduler is forced, each user is
+// switched to it before their cards are rebuilt: a review arriving during
+// the replay then already uses it, and the card it touches is left alone as
+// stale.
+func (s *ReviewService) Replay(ctx context.Context, opts ReplayOptions) (*ReplayResult, error) {
+	result := &ReplayResult{}
+	schedulers := make(map[string]scheduler.Scheduler)
+
+	schedulerFor := func(userID string) (scheduler.Scheduler, error) {
+		if opts.Scheduler != "" {
+			return scheduler.ByName(opts.Scheduler)
+		}
+		if sched, ok := schedulers[userID]; ok {
+			return sched, nil
+		}
+		sched, err := s.SchedulerFor(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		schedulers[userID] = sched
+		return sched, nil
+	}
+
+	var card []models.ReviewLog
+	flush := func() error {
+		if len(card) == 0 {
+			return nil
+		}
+		defer func() { card = card[:0] }()
+		result.Cards++
+
+		if !card[0].FirstReview {
+			result.Partial++
+			return nil
+		}
+
+		first, last := card[0], card[len(card)-1]
+		sched, err := schedulerFor(first.UserID)
+		if err != nil {
+			return err
+		}
+
+		metadata := &models.SRSCardMetadata{
+			UserID:       first.UserID,
+			FlashcardID:  first.FlashcardID,
+			Repetitions:  -1,
+			IntroducedAt: &first.ReviewedAt,
+		}
+		for _, entry := range card {
+			applyReview(metadata, sched, scheduler.Grade(entry.Grade), entry.ReviewedAt)
+			if entry.SessionID != nil {
+				metadata.LastSessionID = entry.SessionID
+			}
+		}
+
+		if opts.DryRun {
+			result.Rebuilt++
+			return nil
+		}
+		err = s.dbService.ReplaceSRSMetadata(ctx, metadata, last.ReviewedAt)
+		if errors.Is(err, ErrReplayStale) {
+			result.Stale++
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to save card %s of user %s: %w", first.FlashcardID, first.UserID, err)
+		}
+		result.Rebuilt++
+		return nil
+	}
+
+	// The log is ordered by user and card, so each card's reviews arrive
+	// together, as do each user's cards
+	lastUserID := ""
+	err := s.dbService.EachReviewLog(ctx, opts.UserID, func(entry *models.ReviewLog) error {
+		result.Reviews++
+		if len(card) > 0 && (card[0].UserID != entry.UserID || card[0].FlashcardID != entry.FlashcardID) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		if entry.UserID != lastUserID {
+			lastUserID = entry.UserID
+			result.Users++
+			if opts.Scheduler != "" && !opts.DryRun {
+				if err := s.dbService.SetUserScheduler(ctx, entry.UserID, opts.Scheduler); err != nil {
+					return fmt.Errorf("failed to switch user %s to %s: %w", entry.UserID, opts.Scheduler, err)
+				}
+			}
+		}
+
+		card = append(card, *entry)
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	return result, flush()
+}
+
+// schedulerState converts stored metadata to scheduler state
+func schedulerState(metadata *models.SRSCardMetadata) scheduler.State {
+	state := scheduler.State{
+		EaseFactor:   metadata.EaseFactor,
+		Interval:     metadata.Interval,
+		Repetitions:  metadata.Repetitions,
+		LastReviewed: metadata.LastReviewed,
+		NextReview:   metadata.NextReview,
+		AgainCount:   metadata.AgainReviewCount,
+		HardCount:    metadata.HardReviewCount,
+		EasyCount:    metadata.EasyReviewCount,
+	}
+	if metadata.Stability != nil && metadata.Difficulty != nil {
+		state.Stability = *metadata.Stability
+		state.Difficulty = *metadata.Difficulty
+	}
+	return state
+}
+
+// DayBounds returns the start and end of the day containing now in loc,
+// which is what "due today" and the daily limits are measured against
+func DayBounds(now time.Time, loc *time.Location) (time.Time, time.Time) {
+	local := now.In(loc)
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1)
+}
@@ -2,6 +2,8 @@ package services
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"time"
@@ -28,6 +30,21 @@ type PresignedUploadResponse struct {
 	ContentType string `json:"contentType"`
 }
 
+// UserUploadPrefix is the path segment a user's uploads are stored under.
+// IDs that are not safe in a path or key are replaced by their hash.
+func UserUploadPrefix(userID string) string {
+	for _, r := range userID {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			sum := sha256.Sum256([]byte(userID))
+			return hex.EncodeToString(sum[:16])
+		}
+	}
+	if userID == "" {
+		return "anonymous"
+	}
+	return userID
+}
+
 func NewS3Service(cfg *memoriva_config.Config) (*S3Service, error) {
 	// Create AWS config with static credentials
 	awsConfig, err := config.LoadDefaultConfig(context.TODO(),
@@ -51,7 +68,7 @@ func NewS3Service(cfg *memoriva_config.Config) (*S3Service, error) {
 	}, nil
 }
 
-func (s *S3Service) GeneratePresignedUploadURL(contentType string) (*PresignedUploadResponse, error) {
+func (s *S3Service) GeneratePresignedUploadURL(userID, contentType string) (*PresignedUploadResponse, error) {
 	// Generate unique key for the image
 	imageID := uuid.New().String()
 	var extension string
@@ -70,7 +87,7 @@ func (s *S3Service) GeneratePresignedUploadURL(contentType string) (*PresignedUp
 		extension = ".jpg" // Default to jpg
 	}
 
-	key := fmt.Sprintf("images/%s%s", imageID, extension)
+	key := fmt.Sprintf("images/%s/%s%s", UserUploadPrefix(userID), imageID, extension)
 
 	// Create presigned URL for PUT operation
 	presignClient := s3.NewPresignClient(s.client)
@@ -99,7 +116,7 @@ func (s *S3Service) GeneratePresignedUploadURL(contentType string) (*PresignedUp
 	}, nil
 }
 
-func (s *S3Service) UploadFile(file io.Reader, contentType string) (string, error) {
+func (s *S3Service) UploadFile(userID string, file io.Reader, contentType string) (string, error) {
 	// Generate unique key for the image
 	imageID := uuid.New().String()
 	var extension string
@@ -118,7 +135,7 @@ func (s *S3Service) UploadFile(file io.Reader, contentType string) (string, erro
 		extension = ".jpg" // Default to jpg
 	}
 
-	key := fmt.Sprintf("images/%s%s", imageID, extension)
+	key := fmt.Sprintf("images/%s/%s%s", UserUploadPrefix(userID), imageID, extension)
 
 	// Upload file directly to S3
 	_, err := s.client.PutObject(context.TODO(), &s3.PutObjectInput{
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"memoriva-backend/models"
+	"memoriva-backend/scheduler"
+	"time"
+)
+
+// WeaknessModel estimates how likely a user is to have forgotten a card by
+// now, using the FSRS forgetting curve. Cards with FSRS state use their
+// stability; others get one estimated from their SM-2 interval and review
+// counters, so a card forgotten often, or not reviewed for long relative to
+// its interval, scores high. It is used by the ranking, the LLM prompt and
+// both fallback selectors; main builds one and hands it to each service, so
+// they agree on which cards are weak.
+type WeaknessModel struct {
+	fsrs scheduler.FSRS
+	// Cards scoring above WeakThreshold are weak; above RepeatThreshold they
+	// are shown twice by the fallback selectors
+	WeakThreshold   float64
+	RepeatThreshold float64
+}
+
+// Schedulers plan reviews at 90% recall, so a card below 80% is overdue
+// enough to count as weak, and one below 60% is probably forgotten
+func NewWeaknessModel() *WeaknessModel {
+	return &WeaknessModel{
+		fsrs:            scheduler.NewFSRS(),
+		WeakThreshold:   0.2,
+		RepeatThreshold: 0.4,
+	}
+}
+
+// Score is the estimated probability, from 0 to 1, that the card is
+// forgotten at now. Unreviewed cards score 0: there is nothing to forget
+// yet. Cards with counters but no review time fall back to the share of
+// again and half of hard answers, as elapsed time is unknown.
+func (m WeaknessModel) Score(metadata *models.SRSCardMetadata, now time.Time) float64 {
+	if metadata == nil {
+		return 0
+	}
+
+	state := schedulerState(metadata)
+	if state.LastReviewed == nil {
+		total := state.AgainCount + state.HardCount + state.EasyCount
+		if total == 0 {
+			return 0
+		}
+		return (float64(state.AgainCount) + float64(state.HardCount)*0.5) / float64(total)
+	}
+
+	if state.Stability <= 0 {
+		state.Stability, state.Difficulty = m.fsrs.InitialState(state)
+	}
+	return 1 - m.fsrs.Retrievability(state, now)
+}
+
+// IsWeak reports whether the card is likely enough to be forgotten to need
+// practice
+func (m WeaknessModel) IsWeak(metadata *models.SRSCardMetadata, now time.Time) bool {
+	return m.Score(metadata, now) > m.WeakThreshold
+}
+
+// NeedsRepeat reports whether the card is likely forgotten, so it is worth
+// showing twice in one session
+func (m WeaknessModel) NeedsRepeat(metadata *models.SRSCardMetadata, now time.Time) bool {
+	return m.Score(metadata, now) > m.RepeatThreshold
+}
@@ -0,0 +1,96 @@
+package services
+
+import (
+	"math"
+	"memoriva-backend/models"
+	"testing"
+	"time"
+)
+
+// Synthetic review histories scored at a fixed time. Expected scores are
+// 1 - R with the FSRS-4.5 forgetting curve R(t, S) = (1 + 19/81 * t/S)^-0.5.
+func TestWeaknessModelScore(t *testing.T) {
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) *time.Time {
+		reviewed := now.AddDate(0, 0, -days)
+		return &reviewed
+	}
+	float := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name     string
+		metadata *models.SRSCardMetadata
+		want     float64
+	}{
+		{"no metadata", nil, 0},
+		{"unreviewed", &models.SRSCardMetadata{EaseFactor: 1.3, Interval: 1, Repetitions: -1}, 0},
+		// Share of again answers plus half the share of hard ones
+		{"counters without review time", &models.SRSCardMetadata{
+			Repetitions: 2, AgainReviewCount: 2, HardReviewCount: 2,
+		}, 0.75},
+		{"counters without review time, all easy", &models.SRSCardMetadata{
+			Repetitions: 3, EasyReviewCount: 3,
+		}, 0},
+		{"FSRS state, just reviewed", &models.SRSCardMetadata{
+			Interval: 10, Repetitions: 3, LastReviewed: daysAgo(0), Stability: float(10), Difficulty: float(5),
+		}, 0},
+		{"FSRS state, reviewed S days ago", &models.SRSCardMetadata{
+			Interval: 10, Repetitions: 3, LastReviewed: daysAgo(10), Stability: float(10), Difficulty: float(5),
+		}, 0.1},
+		{"FSRS state, reviewed 100 S ago", &models.SRSCardMetadata{
+			Interval: 10, Repetitions: 3, LastReviewed: daysAgo(1000), Stability: float(10), Difficulty: float(5),
+		}, 0.7977910976694488},
+		// Stability is estimated as the SM-2 interval
+		{"SM-2 only, due today", &models.SRSCardMetadata{
+			EaseFactor: 2.5, Interval: 6, Repetitions: 2, LastReviewed: daysAgo(6), EasyReviewCount: 1,
+		}, 0.1},
+		{"SM-2 only, overdue", &models.SRSCardMetadata{
+			EaseFactor: 2.5, Interval: 6, Repetitions: 2, LastReviewed: daysAgo(30), AgainReviewCount: 3,
+		}, 0.3215994747000318},
+	}
+
+	m := NewWeaknessModel()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.Score(tt.metadata, now); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Score() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeaknessModelThresholds(t *testing.T) {
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	stability := 10.0
+	difficulty := 5.0
+
+	tests := []struct {
+		days       int
+		score      float64
+		weak       bool
+		needRepeat bool
+	}{
+		{10, 0.1, false, false},
+		{20, 0.17497135267460984, false, false},
+		{30, 0.2338691223171263, true, false},
+		{100, 0.4532889346922917, true, true},
+	}
+
+	m := NewWeaknessModel()
+	for _, tt := range tests {
+		reviewed := now.AddDate(0, 0, -tt.days)
+		metadata := &models.SRSCardMetadata{
+			Interval: 10, Repetitions: 3, LastReviewed: &reviewed, Stability: &stability, Difficulty: &difficulty,
+		}
+
+		if got := m.Score(metadata, now); math.Abs(got-tt.score) > 1e-9 {
+			t.Errorf("%d days: Score() = %v, want %v", tt.days, got, tt.score)
+		}
+		if got := m.IsWeak(metadata, now); got != tt.weak {
+			t.Errorf("%d days: IsWeak() = %v, want %v", tt.days, got, tt.weak)
+		}
+		if got := m.NeedsRepeat(metadata, now); got != tt.needRepeat {
+			t.Errorf("%d days: NeedsRepeat() = %v, want %v", tt.days, got, tt.needRepeat)
+		}
+	}
+}